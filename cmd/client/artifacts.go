@@ -0,0 +1,92 @@
+// This file contains the download of the files a job's tasks output.
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/showalter/bdws/internal/data"
+)
+
+// Download the files the tasks of a job output into <dir>/<job id>/, in a
+// directory for each parameter value.
+func downloadArtifacts(hostName string, id int, reply []byte, dir string) {
+	results, err := data.JsonToTaskResults(reply)
+	checkReply(err)
+
+	// Count the tasks of each parameter, since several runs share one
+	runs := make(map[int]int)
+	for _, result := range results {
+		runs[result.Parameter]++
+	}
+
+	saved := 0
+	for _, result := range results {
+		taskDir := filepath.Join(dir, strconv.Itoa(id), artifactDir(result, runs[result.Parameter] > 1))
+		for _, artifact := range result.Artifacts {
+			if err := downloadArtifact(hostName, result, artifact, taskDir); err != nil {
+				fmt.Printf("Could not download %s of task %s: %v\n", artifact.Name, result.TaskId, err)
+				continue
+			}
+			saved++
+		}
+	}
+
+	if saved > 0 {
+		fmt.Printf("Saved %d output files to %s\n", saved, filepath.Join(dir, strconv.Itoa(id)))
+	}
+}
+
+// Name the directory the output of a task goes in: its parameter value, or
+// the task's number within its job if the task has no parameter or shares
+// it with other runs.
+func artifactDir(result data.TaskResult, sharedParameter bool) string {
+	task := "task-" + result.TaskId
+	if fields := strings.Split(result.TaskId, "."); len(fields) == 3 {
+		task = "task-" + fields[1]
+	}
+	if !result.Parameterized {
+		return task
+	} else if sharedParameter {
+		return filepath.Join(strconv.Itoa(result.Parameter), task)
+	}
+	return strconv.Itoa(result.Parameter)
+}
+
+// Download one file a task output into a directory.
+func downloadArtifact(hostName string, result data.TaskResult, artifact data.Artifact, dir string) error {
+	name, err := data.RelativePath(artifact.Name)
+	if err != nil {
+		return err
+	}
+
+	resp, err := http.Get(fmt.Sprintf("%s/jobs/%d/artifacts/%s/%s", hostName, result.JobId,
+		url.PathEscape(result.TaskId), (&url.URL{Path: name}).EscapedPath()))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("supervisor replied %s: %s", resp.Status, errorMessage(readBody(resp)))
+	}
+
+	path := filepath.Join(dir, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(file, resp.Body)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,123 @@
+// This file contains the packing of jobs whose code is several files.
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/showalter/bdws/internal/data"
+)
+
+// Read a directory or an archive as the code of a job that runs entry from
+// inside it. Returns the code and its bundle format.
+func readBundle(path string, entry string) ([]byte, string) {
+	info, err := os.Stat(path)
+	if err != nil {
+		fmt.Println("Error opening file. Aborting")
+		os.Exit(3)
+	}
+
+	if entry == "" {
+		fmt.Println("Please name the file to run from the directory or archive with -entry")
+		os.Exit(1)
+	}
+
+	// Directories are packed, archives are sent as they are
+	if info.IsDir() {
+		if _, err := os.Stat(filepath.Join(path, entry)); err != nil {
+			fmt.Printf("There is no file %s in %s\n", entry, path)
+			os.Exit(1)
+		}
+		code, err := packDirectory(path)
+		if err != nil {
+			fmt.Printf("Error packing %s: %v. Aborting\n", path, err)
+			os.Exit(3)
+		}
+		return code, data.BundleTar
+	}
+
+	format := data.BundleFormat(path)
+	if format == "" {
+		fmt.Println("-entry can only be used with a directory or a .tar, .tar.gz, .tgz or .zip archive")
+		os.Exit(1)
+	}
+	code, err := ioutil.ReadFile(path)
+	if err != nil {
+		fmt.Println("Error opening file. Aborting")
+		os.Exit(3)
+	}
+	return code, format
+}
+
+// Pack the files under a directory into a tar archive. Links to files are
+// packed as the files they point to.
+func packDirectory(dir string) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		name, err := filepath.Rel(dir, path)
+		if err != nil || name == "." {
+			return err
+		}
+
+		// Follow links, and leave out anything that is not a file or directory
+		if info.Mode()&os.ModeSymlink != 0 {
+			if info, err = os.Stat(path); err != nil || info.IsDir() {
+				fmt.Printf("Leaving %s out of the bundle\n", path)
+				return nil
+			}
+		}
+		if !info.IsDir() && !info.Mode().IsRegular() {
+			fmt.Printf("Leaving %s out of the bundle\n", path)
+			return nil
+		}
+
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(name)
+		if info.IsDir() {
+			header.Name += "/"
+		}
+		if err := tw.WriteHeader(header); err != nil || info.IsDir() {
+			return err
+		}
+
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		_, err = io.Copy(tw, file)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Get the file type of the entrypoint of a bundle, as getFileName does for
+// a single file.
+func entryExtension(entry string) string {
+	base := filepath.Base(entry)
+	if strings.Contains(base, ".") {
+		return strings.Split(base, ".")[1]
+	}
+	return "none"
+}
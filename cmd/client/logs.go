@@ -0,0 +1,72 @@
+// This file contains the printing of the lines a job's tasks output.
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/showalter/bdws/internal/data"
+)
+
+// Longest line the supervisor sends, as json
+const MAX_LOG_LINE = 1 << 20
+
+// Print the lines a job's tasks have output, each with the time the worker
+// read it, its task and its stream. With -f, keep printing the lines that
+// follow until the job finishes.
+func logs(argv []string) {
+	follow := false
+	asJson := false
+	for len(argv) > 0 && (argv[0] == "-f" || argv[0] == "-json") {
+		if argv[0] == "-f" {
+			follow = true
+		} else {
+			asJson = true
+		}
+		argv = argv[1:]
+	}
+	if len(argv) != 2 {
+		fmt.Println("Usage: client logs [-f] [-json] <supervisor> <job id>")
+		os.Exit(1)
+	}
+	id, err := strconv.Atoi(argv[1])
+	if err != nil {
+		fmt.Println("The job id must be a number.")
+		os.Exit(1)
+	}
+
+	target := fmt.Sprintf("%s/jobs/%d/logs", argv[0], id)
+	if follow {
+		target += "?follow=true"
+	}
+	resp, err := http.Get(target)
+	if err != nil {
+		fmt.Println("Error contacting supervisor. Aborting")
+		os.Exit(3)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		fmt.Printf("Supervisor replied %s: %s\n", resp.Status, errorMessage(readBody(resp)))
+		os.Exit(3)
+	}
+
+	// The supervisor sends one line of json per line, as they come
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64<<10), MAX_LOG_LINE)
+	for scanner.Scan() {
+		if asJson {
+			fmt.Println(scanner.Text())
+			continue
+		}
+		line, err := data.JsonToLogLine(scanner.Bytes())
+		checkReply(err)
+		fmt.Printf("%s [%s %s] %s\n", line.Time.Local().Format("2006-01-02 15:04:05.000"), line.TaskId, line.Stream, line.Text)
+	}
+	if err := scanner.Err(); err != nil {
+		fmt.Printf("Lost the connection to the supervisor: %v\n", err)
+		os.Exit(3)
+	}
+}
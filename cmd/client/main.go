@@ -9,6 +9,7 @@ import (
 	"net/http"
 	"os"
 	"os/exec"
+	"os/user"
 	"path/filepath"
 	"strconv"
 	"strings"
@@ -20,23 +21,46 @@ import (
 // The entry point of the program
 func main() {
 
+	// Commands that act on a job that was already submitted
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "status", "results", "artifacts", "priority", "cancel":
+			jobCommand(os.Args[1], os.Args[2:])
+			return
+		case "history":
+			history(os.Args[2:])
+			return
+		case "logs":
+			logs(os.Args[2:])
+			return
+		case "output":
+			output(os.Args[2:])
+			return
+		}
+	}
+
 	// Declare variables
 	var hostName string
 	var fullFileName string
-	var start int
-	var end int
-	var args []string
-	var runs int
+	var job data.Job
+	var detach bool
+	var asJson bool
+	var encoding string
+	var entry string
+	var outputDir string
 
 	// Parse command line
-	parseCommandLine(&hostName, &fullFileName, &start, &end, &args, &runs)
-
-	// Get extension and file name
-	fileName, extension := getFileName(fullFileName)
+	parseCommandLine(&hostName, &fullFileName, &job, &detach, &asJson, &encoding, &entry, &outputDir)
 
-	// Code is unessesary to send if executable exists
+	var fileName, extension string
 	var code []byte
-	if extension == "system program" {
+	if info, err := os.Stat(fullFileName); entry != "" || (err == nil && info.IsDir()) {
+		// Several files are sent as a bundle that runs the entrypoint
+		code, job.Bundle = readBundle(fullFileName, entry)
+		fileName = filepath.ToSlash(filepath.Clean(entry))
+		extension = entryExtension(entry)
+	} else if fileName, extension = getFileName(fullFileName); extension == "system program" {
+		// Code is unessesary to send if executable exists
 		code = nil
 	} else {
 		// File is not an binary executable, so copy code
@@ -49,35 +73,296 @@ func main() {
 		}
 	}
 
-	// Make a job with the given code.
-	jobBytes := data.JobDataToJson(1, time.Now(), 2, start, end, fileName, extension, code, args, runs)
+	// Make a job with the given code. The supervisor assigns the id.
+	job.Time = time.Now()
+	job.Machines = 2
+	job.FileName = fileName
+	job.Extension = extension
+	job.Code = code
+	job.Submitter = submitter()
+
+	// Send a post request to the supervisor. A supervisor that does not
+	// understand the encoding gets the job again as json.
+	resp, reply := postJob(hostName, job, encoding)
+	if resp.StatusCode == http.StatusUnsupportedMediaType && encoding != data.EncodingJson {
+		fmt.Printf("Supervisor does not accept %s, sending the job as json\n", encoding)
+		resp, reply = postJob(hostName, job, data.EncodingJson)
+	}
+
+	// The supervisor replies with the id of the queued job
+	if resp.StatusCode != http.StatusOK {
+		fmt.Printf("Supervisor rejected the job (%s): %s\n", resp.Status, errorMessage(reply))
+		os.Exit(3)
+	}
+	status, err := data.JsonToJobStatus(reply)
+	checkReply(err)
+	fmt.Printf("Submitted job %d\n", status.Id)
+
+	if detach {
+		return
+	}
+
+	// Wait for the job to finish, then print its results
+	for status.Status == data.JobQueued || status.Status == data.JobRunning {
+		time.Sleep(time.Second)
+		status, err = data.JsonToJobStatus(get(hostName, status.Id, ""))
+		checkReply(err)
+	}
+
+	reply = get(hostName, status.Id, "/results")
+	printResults(reply, asJson)
+	if len(job.Outputs) > 0 {
+		downloadArtifacts(hostName, status.Id, reply, outputDir)
+	}
+}
+
+// Handle a command that looks up a submitted job
+func jobCommand(command string, argv []string) {
+	asJson := false
+	if command == "results" && len(argv) > 0 && argv[0] == "-json" {
+		asJson = true
+		argv = argv[1:]
+	}
+	outputDir := "output"
+	if command == "artifacts" && len(argv) > 1 && argv[0] == "-dir" {
+		outputDir = argv[1]
+		argv = argv[2:]
+	}
+
+	if command == "priority" && len(argv) != 3 {
+		fmt.Println("Usage: client priority <supervisor> <job id> <priority>")
+		os.Exit(1)
+	} else if command == "results" && len(argv) != 2 {
+		fmt.Println("Usage: client results [-json] <supervisor> <job id>")
+		os.Exit(1)
+	} else if command == "artifacts" && len(argv) != 2 {
+		fmt.Println("Usage: client artifacts [-dir <directory>] <supervisor> <job id>")
+		os.Exit(1)
+	} else if command != "priority" && len(argv) != 2 {
+		fmt.Printf("Usage: client %s <supervisor> <job id>\n", command)
+		os.Exit(1)
+	}
+
+	id, err := strconv.Atoi(argv[1])
+	if err != nil {
+		fmt.Println("The job id must be a number.")
+		os.Exit(1)
+	}
+
+	switch command {
+	case "status":
+		s, err := data.JsonToJobStatus(get(argv[0], id, ""))
+		checkReply(err)
+		fmt.Printf("Job %d: %s (priority %d)\n", s.Id, s.Status, s.Priority)
+		fmt.Printf("\tTasks: %d (queued %d, running %d, done %d, failed %d, cancelled %d)\n",
+			s.Tasks, s.Queued, s.Running, s.Done, s.Failed, s.Cancelled)
+	case "results":
+		printResults(get(argv[0], id, "/results"), asJson)
+	case "artifacts":
+		downloadArtifacts(argv[0], id, get(argv[0], id, "/results"), outputDir)
+	case "priority":
+		s, err := data.JsonToJobStatus(send(http.MethodPut, argv[0], id, "/priority", []byte(argv[2])))
+		checkReply(err)
+		fmt.Printf("Job %d now has priority %d\n", s.Id, s.Priority)
+	case "cancel":
+		s, err := data.JsonToJobStatus(send(http.MethodDelete, argv[0], id, "", nil))
+		checkReply(err)
+		fmt.Printf("Job %d cancelled: %d tasks never ran, %d were stopped\n", s.Id, s.Cancelled, s.Running)
+		fmt.Println("Use 'client results' to see the output of the tasks that finished")
+	}
+}
+
+// Post a job to the supervisor in an encoding and return the reply
+func postJob(hostName string, job data.Job, encoding string) (*http.Response, []byte) {
+	encoded, err := data.EncodeJob(job, encoding, nil)
+	check(err)
 
-	// Send a post request to the supervisor.
-	resp, err := http.Post(hostName+"/newjob",
-		"text/plain", bytes.NewReader(jobBytes))
+	req, err := http.NewRequest(http.MethodPost, hostName+"/job", encoded.Body)
+	check(err)
+	req.Header.Set("Content-Type", encoded.ContentType)
+	if encoded.ContentEncoding != "" {
+		req.Header.Set("Content-Encoding", encoded.ContentEncoding)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		fmt.Println("Error posting job. Aborting")
 		os.Exit(3)
 	}
+	return resp, readBody(resp)
+}
 
-	// Put the bytes from the request into a file
-	buf := new(bytes.Buffer)
-	buf.ReadFrom(resp.Body)
-	file := buf.String()
+// Print the results of a job, as text unless asJson is set
+func printResults(reply []byte, asJson bool) {
+	if asJson {
+		fmt.Println(string(reply))
+		return
+	}
+
+	results, err := data.JsonToTaskResults(reply)
+	checkReply(err)
+
+	for _, result := range results {
+		if result.Parameterized {
+			fmt.Printf("[Job %d | Parameter %d | Worker %s]\n", result.JobId, result.Parameter, result.Worker)
+		} else {
+			fmt.Printf("[Job %d | Worker %s]\n", result.JobId, result.Worker)
+		}
+		if result.Limit != "" {
+			fmt.Printf("[Client] Job was killed for going over its %s limit\n", result.Limit)
+		} else if result.Signal != "" {
+			fmt.Printf("[Client] Job was killed (%s)\n", result.Signal)
+		} else if result.ExitCode != 0 {
+			fmt.Printf("[Client] Job exited with error code %d\n", result.ExitCode)
+		}
+		if result.Note != "" {
+			fmt.Printf("[Supervisor] %s\n", result.Note)
+		}
+		if result.Orphans > 0 {
+			fmt.Printf("[Worker] Ended %d processes the job left running\n", result.Orphans)
+		}
+		for _, stream := range result.Truncated {
+			fmt.Printf("[Worker] The job's %s was cut off at its output limit\n", stream)
+		}
+		for _, spilled := range result.Spilled {
+			fmt.Printf("[Worker] Only the start of the job's %s (%d bytes) is shown\n", spilled.Stream, spilled.Size)
+			fmt.Printf("[Client] Fetch all of it with: client output <supervisor> %d %s %s\n", result.JobId, result.TaskId, spilled.Stream)
+		}
+		for _, artifact := range result.Artifacts {
+			fmt.Printf("[Output] %s (%d bytes)\n", artifact.Name, artifact.Size)
+		}
+		fmt.Printf("[Stdout]\n%s\n[Stderr]\n%s\n", result.Stdout, result.Stderr)
+	}
+}
+
+// List the jobs a supervisor has finished
+func history(argv []string) {
+	if len(argv) != 1 {
+		fmt.Println("Usage: client history <supervisor>")
+		os.Exit(1)
+	}
+
+	resp, err := http.Get(argv[0] + "/history")
+	if err != nil {
+		fmt.Println("Error contacting supervisor. Aborting")
+		os.Exit(3)
+	}
+	reply := readBody(resp)
+	if resp.StatusCode != http.StatusOK {
+		fmt.Printf("Supervisor replied %s: %s\n", resp.Status, errorMessage(reply))
+		os.Exit(3)
+	}
+
+	summaries, err := data.JsonToHistory(reply)
+	checkReply(err)
+
+	for _, s := range summaries {
+		fmt.Printf("Job %d: %s, submitted %s by %s\n", s.Id, s.Status,
+			s.Submitted.Format("2006-01-02 15:04:05"), s.Submitter)
+		if args := strings.Join(s.Args, " "); args != "NONE" {
+			fmt.Printf("\tFile: %s %s\n", s.FileName, args)
+		} else {
+			fmt.Printf("\tFile: %s\n", s.FileName)
+		}
+		if s.ParameterEnd >= s.ParameterStart {
+			fmt.Printf("\tRange: %d-%d, %d run(s)\n", s.ParameterStart, s.ParameterEnd, s.Nruns)
+		}
+		if !s.Started.IsZero() {
+			fmt.Printf("\tRan for %v after waiting %v\n",
+				s.Finished.Sub(s.Started).Round(time.Millisecond),
+				s.Started.Sub(s.Submitted).Round(time.Millisecond))
+		}
+		fmt.Printf("\tTasks: %d (failed %d), exit codes %v\n", s.Tasks, s.Failed, s.ExitCodes)
+	}
+}
+
+// Name the user submitting a job as user@host
+func submitter() string {
+	name := os.Getenv("USER")
+	if u, err := user.Current(); err == nil {
+		name = u.Username
+	}
+	host, _ := os.Hostname()
+	return name + "@" + host
+}
+
+// Send a GET request for a job and return the body of the reply
+func get(hostName string, id int, path string) []byte {
+	return send(http.MethodGet, hostName, id, path, nil)
+}
+
+// Send a request about a job and return the body of the reply
+func send(method string, hostName string, id int, path string, body []byte) []byte {
+	req, err := http.NewRequest(method, fmt.Sprintf("%s/jobs/%d%s", hostName, id, path), bytes.NewReader(body))
+	check(err)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		fmt.Println("Error contacting supervisor. Aborting")
+		os.Exit(3)
+	}
 
-	fmt.Println(file)
+	reply := readBody(resp)
+	if resp.StatusCode != http.StatusOK {
+		fmt.Printf("Supervisor replied %s: %s\n", resp.Status, errorMessage(reply))
+		os.Exit(3)
+	}
+	return reply
+}
 
+// Get the message out of an error reply from the supervisor
+func errorMessage(reply []byte) string {
+	if e, err := data.JsonToError(reply); err == nil && e.Error != "" {
+		return e.Error
+	}
+	return strings.TrimSpace(string(reply))
+}
+
+// Exit if a reply from the supervisor could not be decoded
+func checkReply(err error) {
+	if err != nil {
+		fmt.Printf("Supervisor sent a reply that could not be read: %v\n", err)
+		os.Exit(3)
+	}
+}
+
+// Read and close the body of a response
+func readBody(resp *http.Response) []byte {
+	buf := new(bytes.Buffer)
+	buf.ReadFrom(resp.Body)
+	resp.Body.Close()
+	return buf.Bytes()
 }
 
 /* ----- Helper functions ----- */
-func parseCommandLine(hostname *string, fullFileName *string, start *int, end *int, args *[]string, runs *int) {
+func parseCommandLine(hostname *string, fullFileName *string, job *data.Job, detach *bool, asJson *bool, encoding *string, entry *string, outputDir *string) {
 	// Optional flags
-	argsPtr := flag.String("args", "NONE", "Command line args for file\nNote: -args \"-r\" is just for gathering results of a previous job\nExample: -args \"-alr\" when running ls")
+	argsPtr := flag.String("args", "NONE", "Command line args for file\nExample: -args \"-alr\" when running ls")
 	rangePtr := flag.String("range", "NONE", "Range for job\nExample: -range 1-10")
 	runsPtr := flag.Int("runs", 1, "Number of times to run job")
+	priorityPtr := flag.Int("priority", 0, "Jobs with a higher priority are run before jobs with a lower one")
+	minCoresPtr := flag.Int("min-cores", 0, "Only run on workers with at least this many cores")
+	minMemoryPtr := flag.Int("min-memory", 0, "Only run on workers with at least this many MB of memory available")
+	cpuModelPtr := flag.String("cpu-model", "", "Only run on workers whose CPU model matches this regular expression\nExample: -cpu-model \"i7-[0-9]+\"")
+	detachPtr := flag.Bool("detach", false, "Print the job id and exit without waiting for results\nUse 'client results' to fetch them later")
+	encodingPtr := flag.String("encoding", data.EncodingBinaryGzip, "How the job is sent to the supervisor: "+strings.Join(data.Encodings, ", "))
+	entryPtr := flag.String("entry", "", "File to run when the job is a directory or a .tar, .tar.gz, .tgz or .zip archive\nExample: -entry src/main.py")
+	outputsPtr := flag.String("outputs", "", "Comma separated patterns of files the tasks write that are collected\nExample: -outputs \"*.csv,plots/*.png\"")
+	outputDirPtr := flag.String("output-dir", "output", "Directory the collected files are saved in, by job id and parameter")
+	jsonPtr := flag.Bool("json", false, "Print the results as json instead of text")
+	timeoutPtr := flag.Duration("timeout", 0, "Wall-clock limit for each task, after which it is killed\nExample: -timeout 90s (default: the supervisor's limit)")
+	cpuTimePtr := flag.Duration("cpu-time", 0, "CPU time each task may use before it is killed\nExample: -cpu-time 10m")
+	maxMemoryPtr := flag.Int64("max-memory", 0, "MB of memory each task may use (of address space on workers without cgroups)")
+	maxFilesPtr := flag.Int("max-open-files", 0, "Files each task may have open at once")
+	maxOutputPtr := flag.Int64("max-output", 0, "MB of stdout and of stderr kept for each task, after which they are cut off (default: the supervisor's limit)")
+	maxProcessesPtr := flag.Int("max-processes", 0, "Processes each task may run at once (counted for the worker's whole user on workers without cgroups)")
+	attemptsPtr := flag.Int("attempts", 1, "Number of times a task that fails is tried before the failure is reported\nLost workers do not use up attempts")
+	backoffPtr := flag.Duration("backoff", 0, "Wait before retrying a failed task, doubled for every retry after it\nExample: -backoff 5s")
+	retryOnPtr := flag.String("retry-on", "", "Comma separated exit codes worth retrying (default: any non-zero code)\nExample: -retry-on 1,75")
+	neverRetryOnPtr := flag.String("never-retry-on", "", "Comma separated exit codes that are never retried\nExample: -never-retry-on 2")
 	flag.Parse()
 
-	*args = strings.Split(*argsPtr, " ")
+	job.Args = strings.Split(*argsPtr, " ")
 
 	// Non optional command line argsgi
 	tail := flag.Args()
@@ -87,6 +372,12 @@ func parseCommandLine(hostname *string, fullFileName *string, start *int, end *i
 		fmt.Println("Please pass the address of the supervisor and a file to run, and an optional range of parameters.")
 		fmt.Println("\tExample: {optional flags} http://stu.cs.jmu.edu:4001 fun_code.py")
 		fmt.Println("\tRun ./client -h for more info on optional flags")
+		fmt.Println("\tUse './client status|results|cancel <supervisor> <job id>' to check on or cancel a submitted job")
+		fmt.Println("\tUse './client priority <supervisor> <job id> <priority>' to re-prioritize a queued job")
+		fmt.Println("\tUse './client history <supervisor>' to list finished jobs")
+		fmt.Println("\tUse './client artifacts [-dir <directory>] <supervisor> <job id>' to download the files a job output")
+		fmt.Println("\tUse './client logs [-f] [-json] <supervisor> <job id>' to print or follow the output of a job's tasks as they run")
+		fmt.Println("\tUse './client output [-bytes start-end] <supervisor> <job id> <task id> <stdout|stderr>' to fetch a task's full output")
 		os.Exit(1)
 	} else {
 		*hostname = tail[0]
@@ -96,10 +387,38 @@ func parseCommandLine(hostname *string, fullFileName *string, start *int, end *i
 	// Set the range
 	// A start index greater than the end index indicates the program should be run once
 	// with no parameters.
-	*start = 0
-	*end = -1
-
-	*runs = *runsPtr
+	job.ParameterStart = 0
+	job.ParameterEnd = -1
+
+	job.Nruns = *runsPtr
+	job.Priority = *priorityPtr
+	job.Requires.MinCores = *minCoresPtr
+	job.Requires.MinMemory = *minMemoryPtr * 1024
+	job.Requires.CpuModel = *cpuModelPtr
+	job.Timeout = *timeoutPtr
+	job.Limits.CpuTime = *cpuTimePtr
+	job.Limits.Memory = *maxMemoryPtr << 20
+	job.Limits.OpenFiles = *maxFilesPtr
+	job.Limits.Processes = *maxProcessesPtr
+	job.Limits.Output = *maxOutputPtr << 20
+	job.Retry.MaxAttempts = *attemptsPtr
+	job.Retry.Backoff = *backoffPtr
+	job.Retry.RetryOn = parseCodes(*retryOnPtr)
+	job.Retry.NeverRetryOn = parseCodes(*neverRetryOnPtr)
+	*detach = *detachPtr
+	*asJson = *jsonPtr
+	*encoding = *encodingPtr
+	*entry = *entryPtr
+	*outputDir = *outputDirPtr
+	for _, pattern := range strings.Split(*outputsPtr, ",") {
+		if strings.TrimSpace(pattern) != "" {
+			job.Outputs = append(job.Outputs, strings.TrimSpace(pattern))
+		}
+	}
+	if !data.ValidEncoding(*encoding) {
+		fmt.Printf("Unknown encoding '%s'\n", *encoding)
+		os.Exit(1)
+	}
 
 	var err error
 
@@ -111,14 +430,31 @@ func parseCommandLine(hostname *string, fullFileName *string, start *int, end *i
 			os.Exit(1)
 		}
 
-		*start, err = strconv.Atoi(split[0])
+		job.ParameterStart, err = strconv.Atoi(split[0])
 		check(err)
 
-		*end, err = strconv.Atoi(split[1])
+		job.ParameterEnd, err = strconv.Atoi(split[1])
 		check(err)
 	}
 }
 
+// Parse a comma separated list of exit codes
+func parseCodes(list string) []int {
+	var codes []int
+	for _, field := range strings.Split(list, ",") {
+		if strings.TrimSpace(field) == "" {
+			continue
+		}
+		code, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil {
+			fmt.Printf("'%s' is not an exit code\n", field)
+			os.Exit(1)
+		}
+		codes = append(codes, code)
+	}
+	return codes
+}
+
 // Check for an error.
 func check(e error) {
 	if e != nil {
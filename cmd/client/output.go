@@ -0,0 +1,56 @@
+// This file contains the fetching of task output too long for a result.
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+
+	"github.com/showalter/bdws/internal/data"
+)
+
+// Print a stream of a task's output the supervisor kept because it was too
+// long for the task's result. With -bytes, print only that range of it.
+func output(argv []string) {
+	byteRange := ""
+	if len(argv) > 1 && argv[0] == "-bytes" {
+		byteRange = argv[1]
+		argv = argv[2:]
+	}
+	if len(argv) != 4 || !data.ValidStream(argv[3]) {
+		fmt.Println("Usage: client output [-bytes start-end] <supervisor> <job id> <task id> <stdout|stderr>")
+		os.Exit(1)
+	}
+	id, err := strconv.Atoi(argv[1])
+	if err != nil {
+		fmt.Println("The job id must be a number.")
+		os.Exit(1)
+	}
+
+	target := fmt.Sprintf("%s/jobs/%d/output/%s/%s", argv[0], id, url.PathEscape(argv[2]), argv[3])
+	req, err := http.NewRequest(http.MethodGet, target, nil)
+	checkReply(err)
+	if byteRange != "" {
+		// Like the Range header, start-end includes end, and either may be left out
+		req.Header.Set("Range", "bytes="+byteRange)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		fmt.Println("Error contacting supervisor. Aborting")
+		os.Exit(3)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		fmt.Printf("Supervisor replied %s: %s\n", resp.Status, errorMessage(readBody(resp)))
+		os.Exit(3)
+	}
+
+	if _, err := io.Copy(os.Stdout, resp.Body); err != nil {
+		fmt.Fprintf(os.Stderr, "Lost the connection to the supervisor: %v\n", err)
+		os.Exit(3)
+	}
+}
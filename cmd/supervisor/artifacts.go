@@ -0,0 +1,183 @@
+/**
+ * This file contains the supervisor's store of the files tasks output.
+ *
+ * A job can name output patterns. When one of its tasks exits, the worker
+ * uploads the files matching them, and they are kept in the state directory
+ * under the job's id and the id of the task's attempt, next to the history,
+ * for the client to download.
+ **/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/showalter/bdws/internal/data"
+)
+
+const ARTIFACTS_DIR = "artifacts"
+const DEFAULT_MAX_ARTIFACT = 1 << 30 /* Bytes a file output by a task may have */
+
+// -- Global Variables --------------------------------------------------------
+var artifactsDir string                      /* Set once the state directory is open */
+var maxArtifact int64 = DEFAULT_MAX_ARTIFACT /* Set with -max-artifact */
+
+// -- Internal Routines -------------------------------------------------------
+
+/** -- artifactPath() ---------------------------------------------------------
+ *  Returns where a file output by a task is stored.
+ *
+ *  @param id      The id of the job
+ *  @param taskId  The id of the task's attempt, see taskId()
+ *  @param name    The cleaned name of the file within the task's directory
+ *  @return The path of the file in the state directory
+ ** ------------------------------------------------------------------------ */
+func artifactPath(id int, taskId string, name string) string {
+	return filepath.Join(artifactsDir, strconv.Itoa(id), taskId, filepath.FromSlash(name))
+}
+
+/** -- validTaskId() ----------------------------------------------------------
+ *  Returns whether a task id names an attempt of a task of the given job.
+ *
+ *  @param id      The id of the job
+ *  @param taskId  The task id to check
+ ** ------------------------------------------------------------------------ */
+func validTaskId(id int, taskId string) bool {
+	fields := strings.Split(taskId, ".")
+	if len(fields) != 3 || fields[0] != strconv.Itoa(id) {
+		return false
+	}
+	for _, field := range fields[1:] {
+		if n, err := strconv.Atoi(field); err != nil || n < 0 {
+			return false
+		}
+	}
+	return true
+}
+
+/** -- storeArtifact() --------------------------------------------------------
+ *  Writes a file uploaded by a worker into the state directory. The file is
+ *  written next to its final name and renamed into place, so a download
+ *  never sees half of it.
+ *
+ *  @param path  Where the file is stored
+ *  @param body  The contents of the file
+ ** ------------------------------------------------------------------------ */
+func storeArtifact(path string, body io.Reader) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".upload-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = io.Copy(tmp, body)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+/** -- uploadBody() -----------------------------------------------------------
+ *  Returns the body of an upload, which fails once it is longer than the
+ *  limit, so a worker cannot fill the supervisor's disk. An upload that says
+ *  up front that it is too long is refused with 413.
+ *
+ *  @param w      Write the reply into this writer
+ *  @param r      Information about the request
+ *  @param limit  Most bytes the upload may have
+ *  @return The body, or false if the upload was refused
+ ** ------------------------------------------------------------------------ */
+func uploadBody(w http.ResponseWriter, r *http.Request, limit int64) (io.Reader, bool) {
+	if r.ContentLength > limit {
+		replyError(w, http.StatusRequestEntityTooLarge,
+			fmt.Sprintf("file is larger than the %d bytes the supervisor accepts", limit))
+		return nil, false
+	}
+	return http.MaxBytesReader(w, r.Body, limit), true
+}
+
+/** -- serveStored() ----------------------------------------------------------
+ *  Serves a file uploaded by a worker, or the byte ranges of it asked for.
+ *
+ *  @param w     Write the reply into this writer
+ *  @param r     Information about the request
+ *  @param path  Where the file is stored
+ ** ------------------------------------------------------------------------ */
+func serveStored(w http.ResponseWriter, r *http.Request, path string) {
+	file, err := os.Open(path)
+	if err != nil {
+		replyError(w, http.StatusNotFound, "no such file")
+		return
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		replyError(w, http.StatusNotFound, "no such file")
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	http.ServeContent(w, r, "", info.ModTime(), file)
+}
+
+/** -- artifactsHandler() -----------------------------------------------------
+ *  Handles the upload and download of the files tasks output.
+ *
+ *  PUT /jobs/{id}/artifacts/{task id}/{name}  Store a file a task output
+ *  GET /jobs/{id}/artifacts/{task id}/{name}  Download it
+ *
+ *  @param w      Write the reply into this writer
+ *  @param r      Information about the request
+ *  @param id     The id of the job
+ *  @param parts  The path of the request after /jobs/
+ ** ------------------------------------------------------------------------ */
+func artifactsHandler(w http.ResponseWriter, r *http.Request, id int, parts []string) {
+	if len(parts) < 4 || !validTaskId(id, parts[2]) {
+		replyError(w, http.StatusNotFound, "not found")
+		return
+	}
+	name, err := data.RelativePath(strings.Join(parts[3:], "/"))
+	if err != nil || name == "." {
+		replyError(w, http.StatusBadRequest, "invalid file name")
+		return
+	}
+	path := artifactPath(id, parts[2], name)
+
+	switch r.Method {
+	case http.MethodPut:
+		/* Only tasks of jobs the supervisor knows about upload files */
+		if _, ok := lookupJob(id); !ok {
+			replyError(w, http.StatusNotFound, fmt.Sprintf("no job with id %d", id))
+			return
+		}
+		body, ok := uploadBody(w, r, maxArtifact)
+		if !ok {
+			return
+		}
+		if err := storeArtifact(path, body); err != nil {
+			fmt.Printf("[Supervisor] Could not store %s of task %s: %v\n", name, parts[2], err)
+			replyError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+	case http.MethodGet:
+		serveStored(w, r, path)
+
+	default:
+		replyError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/showalter/bdws/internal/data"
+)
+
+func TestValidTaskId(t *testing.T) {
+	tests := []struct {
+		taskId string
+		want   bool
+	}{
+		{"7.0.1", true},
+		{"7.41.12", true},
+		{"8.0.1", false},
+		{"70.0.1", false},
+		{"7.0", false},
+		{"7.0.1.1", false},
+		{"7.-1.1", false},
+		{"7.0.-1", false},
+		{"7.a.1", false},
+		{"7..1", false},
+		{"7.0.1/..", false},
+		{"..", false},
+		{"", false},
+	}
+
+	for _, test := range tests {
+		if got := validTaskId(7, test.taskId); got != test.want {
+			t.Errorf("validTaskId(7, %q) = %v, want %v", test.taskId, got, test.want)
+		}
+	}
+}
+
+func TestArtifactLimit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bdws-supervisor-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	artifactsDir = dir
+
+	const limit = 1000
+	defer func(saved int64) { maxArtifact = saved }(maxArtifact)
+	maxArtifact = limit
+
+	const id = 42
+	jobsMutex.Lock()
+	jobs[id] = &ActiveJob{job: data.Job{Id: id}}
+	jobsMutex.Unlock()
+	defer func() {
+		jobsMutex.Lock()
+		delete(jobs, id)
+		jobsMutex.Unlock()
+	}()
+
+	server := httptest.NewServer(http.HandlerFunc(jobsHandler))
+	defer server.Close()
+
+	tests := []struct {
+		name    string
+		size    int
+		chunked bool // Whether the size is left out, as it is when streaming
+		status  int  // 0 for any error
+	}{
+		{"empty", 0, false, http.StatusOK},
+		{"at the limit", limit, false, http.StatusOK},
+		{"over the limit", limit + 1, false, http.StatusRequestEntityTooLarge},
+		{"streamed at the limit", limit, true, http.StatusOK},
+		{"streamed over the limit", 100 * limit, true, 0},
+	}
+
+	for i, test := range tests {
+		url := fmt.Sprintf("%s/jobs/%d/artifacts/%d.0.1/out-%d.csv", server.URL, id, id, i)
+		body := bytes.NewReader(make([]byte, test.size))
+		req, err := http.NewRequest(http.MethodPut, url, body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.chunked {
+			req.ContentLength = -1
+			req.Body = ioutil.NopCloser(body)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		status := 0
+		if err == nil {
+			status = resp.StatusCode
+			resp.Body.Close()
+		}
+
+		if test.status != 0 && status != test.status {
+			t.Errorf("%s: got %d (%v), want %d", test.name, status, err, test.status)
+		} else if test.status == 0 && status == http.StatusOK {
+			t.Errorf("%s: the upload was stored", test.name)
+		}
+
+		_, err = os.Stat(artifactPath(id, fmt.Sprintf("%d.0.1", id), fmt.Sprintf("out-%d.csv", i)))
+		if stored := err == nil; stored != (test.status == http.StatusOK) {
+			t.Errorf("%s: stored %v, want %v", test.name, stored, test.status == http.StatusOK)
+		}
+	}
+}
@@ -0,0 +1,288 @@
+/**
+ * This file contains the supervisor's history of finished jobs.
+ *
+ * When a job finishes, is cancelled or fails, its results are archived in the
+ * state directory under its id together with a summary: who submitted it,
+ * what it ran, when it ran and how its tasks exited. The history can be
+ * listed with GET /history. Archived jobs are dropped from memory, so their
+ * status and results are served from here, even if the job's log was
+ * deleted.
+ **/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/showalter/bdws/internal/data"
+)
+
+const HISTORY_DIR = "history"
+
+// -- Internal Structs --------------------------------------------------------
+
+/**
+ * A finished job as it is stored in the history.
+ **/
+type archivedJob struct {
+	Summary data.JobSummary
+	Results []data.TaskResult
+}
+
+// -- Global Variables --------------------------------------------------------
+var historyDir string /* Set once the state directory is open */
+var historyMutex = &sync.Mutex{}
+
+// -- Internal Routines -------------------------------------------------------
+
+/** -- archivePath() ----------------------------------------------------------
+ *  Returns the file that holds the archive of a job.
+ *
+ *  @param id  The id of the job
+ ** ------------------------------------------------------------------------ */
+func archivePath(id int) string {
+	return filepath.Join(historyDir, strconv.Itoa(id)+".json")
+}
+
+/** -- summarize() ------------------------------------------------------------
+ *  Describes a job for the history. Called with jobsMutex held.
+ *
+ *  @param active  The job
+ *  @return The summary of the job and its results, ordered by parameter
+ ** ------------------------------------------------------------------------ */
+func summarize(active *ActiveJob) archivedJob {
+	results := make([]data.TaskResult, len(active.results))
+	copy(results, active.results)
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].Parameter < results[j].Parameter
+	})
+
+	exitCodes := make([]int, len(results))
+	for i, result := range results {
+		exitCodes[i] = result.ExitCode
+	}
+
+	job := active.job
+	return archivedJob{
+		Summary: data.JobSummary{
+			Id:             job.Id,
+			Status:         active.status,
+			Submitter:      job.Submitter,
+			FileName:       job.FileName,
+			Args:           job.Args,
+			ParameterStart: job.ParameterStart,
+			ParameterEnd:   job.ParameterEnd,
+			Nruns:          job.Nruns,
+			Tasks:          active.nTasks,
+			Failed:         active.failed,
+			ExitCodes:      exitCodes,
+			Submitted:      active.submitted,
+			Started:        active.started,
+			Finished:       active.finished,
+		},
+		Results: results,
+	}
+}
+
+/** -- archiveJob() -----------------------------------------------------------
+ *  Writes a finished job and its results to the history, and lets go of the
+ *  job's log records once the job is over. Called with jobsMutex held, which
+ *  is released while the disk is written to so other jobs are not held up;
+ *  the job is not retired meanwhile.
+ *
+ *  @param active    The job
+ *  @param finished  Whether the job is over, so its log records are no
+ *                   longer needed
+ ** ------------------------------------------------------------------------ */
+func archiveJob(active *ActiveJob, finished bool) {
+	archive := summarize(active)
+	active.archives++
+	active.archiving++
+	seq := active.archives
+	jobsMutex.Unlock()
+
+	writeArchive(active, archive, seq)
+	if finished {
+		finishLog(active.job.Id)
+	}
+
+	jobsMutex.Lock()
+	active.archiving--
+}
+
+/** -- writeArchive() ---------------------------------------------------------
+ *  Writes an archive of a job to the history, unless a later one of the
+ *  job was written first.
+ *
+ *  @param active   The job
+ *  @param archive  The summary of the job and its results
+ *  @param seq      Which of the job's archives this is
+ ** ------------------------------------------------------------------------ */
+func writeArchive(active *ActiveJob, archive archivedJob, seq int) {
+	historyMutex.Lock()
+	defer historyMutex.Unlock()
+
+	if historyDir == "" || seq < active.archived {
+		return
+	}
+	active.archived = seq
+
+	b, err := json.Marshal(archive)
+	if err != nil {
+		panic(err)
+	}
+
+	/* Write the whole archive before it replaces the old one */
+	path := archivePath(active.job.Id)
+	if err := ioutil.WriteFile(path+".tmp", b, 0644); err != nil {
+		fmt.Printf("[Supervisor] Could not archive job %d: %v\n", active.job.Id, err)
+		return
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		fmt.Printf("[Supervisor] Could not archive job %d: %v\n", active.job.Id, err)
+	}
+}
+
+/** -- archived() -------------------------------------------------------------
+ *  Returns whether a job is in the history.
+ *
+ *  @param id  The id of the job
+ ** ------------------------------------------------------------------------ */
+func archived(id int) bool {
+	_, err := os.Stat(archivePath(id))
+	return err == nil
+}
+
+/** -- loadArchive() ----------------------------------------------------------
+ *  Reads a job from the history.
+ *
+ *  @param id  The id of the job
+ *  @return The archived job and whether it was found
+ ** ------------------------------------------------------------------------ */
+func loadArchive(id int) (archivedJob, bool) {
+	var archive archivedJob
+
+	b, err := ioutil.ReadFile(archivePath(id))
+	if err != nil {
+		return archive, false
+	}
+	if err := json.Unmarshal(b, &archive); err != nil {
+		fmt.Printf("[Supervisor] Archive of job %d is damaged: %v\n", id, err)
+		return archive, false
+	}
+	return archive, true
+}
+
+/** -- archivedStatus() -------------------------------------------------------
+ *  Reports the status of a job from the history.
+ *
+ *  @param summary  The archived summary of the job
+ *  @return The status of the job
+ ** ------------------------------------------------------------------------ */
+func archivedStatus(summary data.JobSummary) data.JobStatus {
+	status := data.JobStatus{
+		Id:        summary.Id,
+		Status:    summary.Status,
+		Tasks:     summary.Tasks,
+		Done:      len(summary.ExitCodes) - summary.Failed,
+		Failed:    summary.Failed,
+		Submitted: summary.Submitted,
+		Finished:  summary.Finished,
+	}
+
+	/* Only a cancelled job is archived with tasks that never ran */
+	if summary.Status == data.JobCancelled {
+		status.Cancelled = summary.Tasks - len(summary.ExitCodes)
+	}
+	return status
+}
+
+/** -- archivedIds() ----------------------------------------------------------
+ *  Returns the ids of the jobs in the history, in order.
+ ** ------------------------------------------------------------------------ */
+func archivedIds() []int {
+	files, err := ioutil.ReadDir(historyDir)
+	if err != nil {
+		return nil
+	}
+
+	var ids []int
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+		if id, err := strconv.Atoi(strings.TrimSuffix(file.Name(), ".json")); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+/** -- serveArchive() ---------------------------------------------------------
+ *  Handles a request for the status or results of a job that is only in the
+ *  history.
+ *
+ *  @param w      Write the reply into this writer
+ *  @param r      Information about the request
+ *  @param id     The id of the job
+ *  @param parts  The path of the request below /jobs/
+ ** ------------------------------------------------------------------------ */
+func serveArchive(w http.ResponseWriter, r *http.Request, id int, parts []string) {
+	archive, ok := loadArchive(id)
+	if !ok {
+		replyError(w, http.StatusNotFound, fmt.Sprintf("no job with id %d", id))
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodGet && len(parts) == 1:
+		reply, err := data.JobStatusToJson(archivedStatus(archive.Summary))
+		replyJson(w, reply, err)
+	case r.Method == http.MethodGet && len(parts) == 2 && parts[1] == "results":
+		reply, err := formatResults(archive.Results)
+		replyJson(w, reply, err)
+	case r.Method == http.MethodPut && len(parts) == 2 && parts[1] == "priority":
+		replyError(w, http.StatusConflict, "job is no longer queued")
+	case r.Method == http.MethodDelete && len(parts) == 1:
+		replyError(w, http.StatusConflict, "job has already finished")
+	case len(parts) <= 2:
+		replyError(w, http.StatusMethodNotAllowed, "method not allowed")
+	default:
+		replyError(w, http.StatusNotFound, "not found")
+	}
+}
+
+/** -- historyHandler() -------------------------------------------------------
+ *  Lists the jobs in the history, oldest first.
+ *
+ *  GET /history  Summaries of every archived job
+ *
+ *  @param w  Write the reply into this writer
+ *  @param r  Information about the request
+ ** ------------------------------------------------------------------------ */
+func historyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		replyError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	history := []data.JobSummary{}
+	for _, id := range archivedIds() {
+		if archive, ok := loadArchive(id); ok {
+			history = append(history, archive.Summary)
+		}
+	}
+
+	reply, err := data.HistoryToJson(history)
+	replyJson(w, reply, err)
+}
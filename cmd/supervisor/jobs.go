@@ -0,0 +1,526 @@
+/**
+ * This file contains the supervisor's table of submitted jobs and the HTTP
+ * handlers that report their status and results.
+ *
+ * Jobs are assigned an id when they are submitted so a client can disconnect
+ * and come back later for the results.
+ **/
+
+package main
+
+import (
+	"container/heap"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/showalter/bdws/internal/data"
+)
+
+// -- Internal Structs --------------------------------------------------------
+
+/**
+ * A job that has been accepted by the supervisor and the progress of its
+ * tasks. Fields are protected by jobsMutex. Once the job is archived and
+ * none of its tasks are left running it is dropped from the jobs table.
+ **/
+type ActiveJob struct {
+	job       data.Job
+	status    string
+	nTasks    int
+	running   int
+	failed    int
+	results   []data.TaskResult
+	submitted time.Time
+	started   time.Time
+	finished  time.Time
+	done      chan struct{} /* Closed once every task has finished */
+	item      *Item         /* Place in the job queue while the job waits */
+	pending   []Task        /* Tasks waiting for a worker while the job is active */
+	inFlight  map[int]dispatched
+	served    uint64        /* When the job last had a task picked, for fair scheduling */
+	logged    chan struct{} /* Closed when lines are logged, see logChanged() */
+	archives  int           /* Archives of the job summarized, see archiveJob() */
+	archiving int           /* Archives of the job being written */
+	archived  int           /* The last archive written, guarded by historyMutex */
+
+	modelPattern *regexp.Regexp /* Compiled from job.Requires.CpuModel */
+
+	packOnce sync.Once
+	packed   []byte /* job.Code compressed once for all workers, see packedCode() */
+}
+
+/**
+ * A task that has been handed to a worker and is not finished.
+ **/
+type dispatched struct {
+	task   Task
+	worker ProtectedWorker
+}
+
+// -- Global Variables --------------------------------------------------------
+var jobs = make(map[int]*ActiveJob) /* Unfinished jobs; finished ones are only in the history */
+var jobsMutex = &sync.Mutex{}
+var nextJobId = 1
+
+/* Jobs waiting to be split into tasks, highest priority first */
+var jobQueue = &PriorityQueue{}
+var jobQueued = sync.NewCond(jobsMutex)
+
+// -- Internal Routines -------------------------------------------------------
+
+/** -- addJob() ---------------------------------------------------------------
+ *  Assigns a job an id and records it as queued. The job is in the log by
+ *  the time this returns.
+ *
+ *  @param job           The job submitted by a client
+ *  @param modelPattern  The job's CPU model requirement
+ *  @return The tracked job
+ ** ------------------------------------------------------------------------ */
+func addJob(job data.Job, modelPattern *regexp.Regexp) *ActiveJob {
+	jobsMutex.Lock()
+	defer jobsMutex.Unlock()
+
+	job.Id = nextJobId
+	nextJobId++
+	if len(job.Code) > 0 {
+		job.CodeHash = data.HashCode(job.Code)
+	}
+
+	active := &ActiveJob{
+		job:       job,
+		status:    data.JobQueued,
+		submitted: time.Now(),
+		done:      make(chan struct{}),
+		inFlight:  make(map[int]dispatched),
+
+		modelPattern: modelPattern,
+	}
+	jobs[job.Id] = active
+	logRecord(Record{Type: RecordJob, JobId: job.Id, Job: &job})
+
+	return active
+}
+
+/** -- enqueueJob() -----------------------------------------------------------
+ *  Places a job in the job queue according to its priority.
+ *
+ *  @param active  The job to queue
+ ** ------------------------------------------------------------------------ */
+func enqueueJob(active *ActiveJob) {
+	jobsMutex.Lock()
+	defer jobsMutex.Unlock()
+
+	active.item = &Item{priority: active.job.Priority, job: active}
+	heap.Push(jobQueue, active.item)
+	jobQueued.Signal()
+}
+
+/** -- nextJob() --------------------------------------------------------------
+ *  Waits for a job and removes the highest priority one from the job queue.
+ *
+ *  @return The job to run next
+ ** ------------------------------------------------------------------------ */
+func nextJob() *ActiveJob {
+	jobsMutex.Lock()
+	defer jobsMutex.Unlock()
+
+	for jobQueue.Len() == 0 {
+		jobQueued.Wait()
+	}
+
+	active := heap.Pop(jobQueue).(*Item).job
+	active.item = nil
+	return active
+}
+
+/** -- reprioritize() ---------------------------------------------------------
+ *  Changes the priority of a job that is still waiting in the job queue.
+ *
+ *  @param active    The job
+ *  @param priority  Its new priority
+ *  @return FALSE if the job has already left the queue
+ ** ------------------------------------------------------------------------ */
+func reprioritize(active *ActiveJob, priority int) bool {
+	jobsMutex.Lock()
+	defer jobsMutex.Unlock()
+
+	if active.item == nil {
+		return false
+	}
+
+	active.job.Priority = priority
+	jobQueue.update(active.item, priority)
+	logRecord(Record{Type: RecordPriority, JobId: active.job.Id, Priority: priority})
+	return true
+}
+
+/** -- retireJob() ------------------------------------------------------------
+ *  Drops a job that has been archived from the jobs table, along with its
+ *  code and results, once it has no task left running and its archive is
+ *  written. Its status and results are served from the history after that.
+ *  Called with jobsMutex held.
+ *
+ *  @param active  The job
+ ** ------------------------------------------------------------------------ */
+func retireJob(active *ActiveJob) {
+	if active.running > 0 || active.archiving > 0 {
+		return
+	}
+	delete(jobs, active.job.Id)
+}
+
+/** -- lookupJob() ------------------------------------------------------------
+ *  Finds a job that has not finished by its id.
+ *
+ *  @param id  The id of the job
+ *  @return The job and whether it exists
+ ** ------------------------------------------------------------------------ */
+func lookupJob(id int) (*ActiveJob, bool) {
+	jobsMutex.Lock()
+	defer jobsMutex.Unlock()
+
+	active, ok := jobs[id]
+	return active, ok
+}
+
+/** -- lookupCode() -----------------------------------------------------------
+ *  Finds a job whose code has the given hash. Workers only ask for code they
+ *  have not cached, for tasks of jobs that have not finished, so a scan of
+ *  the jobs is rare.
+ *
+ *  @param hash  The data.HashCode of the code
+ *  @return A job with that code and whether there is one
+ ** ------------------------------------------------------------------------ */
+func lookupCode(hash string) (*ActiveJob, bool) {
+	jobsMutex.Lock()
+	defer jobsMutex.Unlock()
+
+	for _, active := range jobs {
+		if active.job.CodeHash == hash {
+			return active, true
+		}
+	}
+	return nil, false
+}
+
+/** -- taskStarted() ----------------------------------------------------------
+ *  Records that a task of a job has been handed to a worker.
+ *
+ *  @param task     The task being dispatched
+ *  @param pWorker  The worker it is dispatched to
+ *  @return FALSE if the job was cancelled and the task should not run
+ ** ------------------------------------------------------------------------ */
+func taskStarted(task Task, pWorker ProtectedWorker) bool {
+	jobsMutex.Lock()
+	defer jobsMutex.Unlock()
+
+	if task.job.status == data.JobCancelled {
+		return false
+	}
+
+	task.job.running++
+	task.job.inFlight[task.Index] = dispatched{task, pWorker}
+	logRecord(Record{Type: RecordAttempt, JobId: task.JobId, Index: task.Index,
+		Attempt: task.Attempt, Worker: pWorker.worker.Hostname})
+	return true
+}
+
+/** -- taskRequeued() ---------------------------------------------------------
+ *  Records that a dispatched task went back into the task queue.
+ *
+ *  @param task  The task being requeued
+ ** ------------------------------------------------------------------------ */
+func taskRequeued(task Task) {
+	jobsMutex.Lock()
+	defer jobsMutex.Unlock()
+
+	task.job.running--
+	delete(task.job.inFlight, task.Index)
+
+	/* The job was cancelled while the task was on its way back */
+	if task.job.status == data.JobCancelled {
+		retireJob(task.job)
+	}
+}
+
+/** -- taskFinished() ---------------------------------------------------------
+ *  Stores the result of a task and completes the job once every task has
+ *  reported back. Tasks that were running when their job was cancelled are
+ *  kept as partial results.
+ *
+ *  @param task    The task that finished
+ *  @param result  The output of the task
+ ** ------------------------------------------------------------------------ */
+func taskFinished(task Task, result data.TaskResult) {
+	jobsMutex.Lock()
+	defer jobsMutex.Unlock()
+
+	active := task.job
+	active.running--
+	delete(active.inFlight, task.Index)
+	active.results = append(active.results, result)
+	if result.Failed {
+		active.failed++
+	}
+	logRecord(Record{Type: RecordResult, JobId: task.JobId, Index: task.Index, Result: &result})
+
+	if active.status == data.JobCancelled {
+		/* Keep the archive up to date with the partial result */
+		archiveJob(active, false)
+		retireJob(active)
+		return
+	}
+
+	if len(active.results) == active.nTasks {
+		active.status = data.JobDone
+		if active.failed > 0 {
+			active.status = data.JobFailed
+		}
+		active.finished = time.Now()
+		close(active.done)
+		deactivateJob(active)
+		archiveJob(active, true)
+		retireJob(active)
+	}
+}
+
+/** -- cancelled() ------------------------------------------------------------
+ *  Returns whether a job has been cancelled.
+ *
+ *  @param active  The job
+ ** ------------------------------------------------------------------------ */
+func cancelled(active *ActiveJob) bool {
+	jobsMutex.Lock()
+	defer jobsMutex.Unlock()
+
+	return active.status == data.JobCancelled
+}
+
+/** -- cancelJob() ------------------------------------------------------------
+ *  Cancels a job that has not finished. Its waiting tasks are dropped and the
+ *  workers running the rest are told to kill them; whatever those tasks
+ *  report back is kept as partial results.
+ *
+ *  @param active  The job to cancel
+ *  @return FALSE if the job had already finished
+ ** ------------------------------------------------------------------------ */
+func cancelJob(active *ActiveJob) bool {
+	jobsMutex.Lock()
+	defer jobsMutex.Unlock()
+
+	switch active.status {
+	case data.JobQueued:
+		/* The job may have just been taken from the queue to be activated */
+		if active.item != nil {
+			heap.Remove(jobQueue, active.item.index)
+			active.item = nil
+		}
+	case data.JobRunning:
+		active.pending = nil
+		for _, d := range active.inFlight {
+			go killTask(d.task, d.worker)
+		}
+		deactivateJob(active)
+	default:
+		return false
+	}
+
+	logRecord(Record{Type: RecordCancel, JobId: active.job.Id})
+	active.status = data.JobCancelled
+	active.finished = time.Now()
+	close(active.done)
+	archiveJob(active, true)
+	retireJob(active)
+	fmt.Printf("[Supervisor] Cancelled job %d.\n", active.job.Id)
+
+	return true
+}
+
+/** -- jobStatus() ------------------------------------------------------------
+ *  Summarizes the state of a job and its tasks.
+ *
+ *  @param active  The job to summarize
+ *  @return The status of the job
+ ** ------------------------------------------------------------------------ */
+func jobStatus(active *ActiveJob) data.JobStatus {
+	jobsMutex.Lock()
+	defer jobsMutex.Unlock()
+
+	finished := len(active.results)
+	status := data.JobStatus{
+		Id:        active.job.Id,
+		Status:    active.status,
+		Priority:  active.job.Priority,
+		Tasks:     active.nTasks,
+		Queued:    active.nTasks - finished - active.running,
+		Running:   active.running,
+		Done:      finished - active.failed,
+		Failed:    active.failed,
+		Submitted: active.submitted,
+		Finished:  active.finished,
+	}
+
+	/* Tasks that were waiting when the job was cancelled will never run */
+	if active.status == data.JobCancelled {
+		status.Cancelled, status.Queued = status.Queued, 0
+	}
+	return status
+}
+
+/** -- jobResults() -----------------------------------------------------------
+ *  Copies the results a job has gathered so far.
+ *
+ *  @param active  The job
+ *  @return The results of the tasks that have finished
+ ** ------------------------------------------------------------------------ */
+func jobResults(active *ActiveJob) []data.TaskResult {
+	jobsMutex.Lock()
+	defer jobsMutex.Unlock()
+
+	results := make([]data.TaskResult, len(active.results))
+	copy(results, active.results)
+	return results
+}
+
+/** -- jobsHandler() ----------------------------------------------------------
+ *  Handles requests for a job's status or results, changes to its priority,
+ *  and its cancellation.
+ *
+ *  GET /jobs/{id}           Status of the job and counts of its tasks
+ *  GET /jobs/{id}/results   Output of the tasks that have finished
+ *  PUT /jobs/{id}/priority  Re-prioritize a queued job, the body is the new
+ *                           priority
+ *  DELETE /jobs/{id}        Cancel the job
+ *  /jobs/{id}/artifacts/... Files output by the tasks, see artifactsHandler()
+ *  /jobs/{id}/output/...    Output too long for the results, see
+ *                           outputHandler()
+ *  /jobs/{id}/logs/...      Lines output by the tasks, see logsHandler()
+ *
+ *  @param w  Write the reply into this writer
+ *  @param r  Information about the request
+ ** ------------------------------------------------------------------------ */
+func jobsHandler(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/jobs/"), "/"), "/")
+
+	id, err := strconv.Atoi(parts[0])
+	if err != nil {
+		replyError(w, http.StatusBadRequest, "invalid job id")
+		return
+	}
+
+	/* Files output by tasks are kept after the job is archived */
+	if len(parts) >= 2 && parts[1] == "artifacts" {
+		artifactsHandler(w, r, id, parts)
+		return
+	}
+	if len(parts) >= 2 && parts[1] == "output" {
+		outputHandler(w, r, id, parts)
+		return
+	}
+	if len(parts) >= 2 && parts[1] == "logs" {
+		logsHandler(w, r, id, parts)
+		return
+	}
+
+	active, ok := lookupJob(id)
+	if !ok {
+		/* The job may only be left in the history */
+		serveArchive(w, r, id, parts)
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodGet && len(parts) == 1:
+		reply, err := data.JobStatusToJson(jobStatus(active))
+		replyJson(w, reply, err)
+	case r.Method == http.MethodGet && len(parts) == 2 && parts[1] == "results":
+		reply, err := formatResults(jobResults(active))
+		replyJson(w, reply, err)
+	case r.Method == http.MethodPut && len(parts) == 2 && parts[1] == "priority":
+		setPriority(w, r, active)
+	case r.Method == http.MethodDelete && len(parts) == 1:
+		if !cancelJob(active) {
+			replyError(w, http.StatusConflict, "job has already finished")
+			return
+		}
+		reply, err := data.JobStatusToJson(jobStatus(active))
+		replyJson(w, reply, err)
+	case len(parts) <= 2:
+		replyError(w, http.StatusMethodNotAllowed, "method not allowed")
+	default:
+		replyError(w, http.StatusNotFound, "not found")
+	}
+}
+
+/** -- setPriority() ----------------------------------------------------------
+ *  Handles an admin request to re-prioritize a queued job.
+ *
+ *  @param w       Write the reply into this writer
+ *  @param r       Information about the request
+ *  @param active  The job to re-prioritize
+ ** ------------------------------------------------------------------------ */
+func setPriority(w http.ResponseWriter, r *http.Request, active *ActiveJob) {
+	buf, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		replyError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	priority, err := strconv.Atoi(strings.TrimSpace(string(buf)))
+	if err != nil {
+		replyError(w, http.StatusBadRequest, "priority must be an integer")
+		return
+	}
+
+	if !reprioritize(active, priority) {
+		replyError(w, http.StatusConflict, "job is no longer queued")
+		return
+	}
+
+	fmt.Printf("[Supervisor] Job %d now has priority %d.\n", active.job.Id, priority)
+	reply, err := data.JobStatusToJson(jobStatus(active))
+	replyJson(w, reply, err)
+}
+
+/** -- codeHandler() ----------------------------------------------------------
+ *  Serves the code of a job to a worker that does not have it cached.
+ *
+ *  GET /code/{hash}  The raw code, gzip compressed if the worker accepts it
+ *
+ *  @param w  Write the reply into this writer
+ *  @param r  Information about the request
+ ** ------------------------------------------------------------------------ */
+func codeHandler(w http.ResponseWriter, r *http.Request) {
+	hash := strings.TrimPrefix(r.URL.Path, "/code/")
+	if r.Method != http.MethodGet {
+		replyError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if !data.ValidCodeHash(hash) {
+		replyError(w, http.StatusBadRequest, "invalid code hash")
+		return
+	}
+
+	active, ok := lookupCode(hash)
+	if !ok {
+		replyError(w, http.StatusNotFound, "no code with hash "+hash)
+		return
+	}
+
+	/* Send the code compressed once for every worker that asks */
+	w.Header().Set("Content-Type", "application/octet-stream")
+	if strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+		if packed := packedCode(active); packed != nil {
+			w.Header().Set("Content-Encoding", "gzip")
+			w.Write(packed)
+			return
+		}
+	}
+	w.Write(active.job.Code)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/showalter/bdws/internal/data"
+)
+
+// Send a request for a job to the jobs handler and decode the status it
+// replies with.
+func requestStatus(t *testing.T, method string, id int) data.JobStatus {
+	w := httptest.NewRecorder()
+	jobsHandler(w, httptest.NewRequest(method, "/jobs/"+strconv.Itoa(id), nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("%s /jobs/%d: got %d: %s", method, id, w.Code, w.Body.String())
+	}
+	status, err := data.JsonToJobStatus(w.Body.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return status
+}
+
+func TestCancelledJobStatus(t *testing.T) {
+	dir, cleanup := emptyStore(t)
+	defer cleanup()
+	if err := openStore(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing listens on this worker, so killing its task just fails
+	pWorker := addWorker(data.Registration{Hostname: "127.0.0.1:1"})
+	defer evictWorker(pWorker.worker.Id, "test over")
+
+	active, tasks := submit(4, true)
+	finish(tasks[0], "1")
+	taskStarted(tasks[1], pWorker)
+	id := active.job.Id
+
+	// A job with a task done, one running and two waiting when it was
+	// cancelled, then once the running task has reported back
+	tests := []struct {
+		name   string
+		method string
+		step   func()
+		want   data.JobStatus
+	}{
+		{"cancel reply", http.MethodDelete, func() {},
+			data.JobStatus{Tasks: 4, Running: 1, Done: 1, Cancelled: 2}},
+		{"cancelled", http.MethodGet, func() {},
+			data.JobStatus{Tasks: 4, Running: 1, Done: 1, Cancelled: 2}},
+		{"archived", http.MethodGet, func() {
+			taskFinished(tasks[1], data.TaskResult{Parameter: tasks[1].Parameter,
+				Failed: true, Failure: data.FailureCancelled})
+		}, data.JobStatus{Tasks: 4, Done: 1, Failed: 1, Cancelled: 2}},
+	}
+
+	for _, test := range tests {
+		test.step()
+		got := requestStatus(t, test.method, id)
+		if got.Status != data.JobCancelled {
+			t.Errorf("%s: got status %q, want %q", test.name, got.Status, data.JobCancelled)
+		}
+		got.Id, got.Status, got.Priority, got.Version = 0, "", 0, 0
+		got.Submitted, got.Finished = test.want.Submitted, test.want.Finished
+		if got != test.want {
+			t.Errorf("%s: got %+v, want %+v", test.name, got, test.want)
+		}
+	}
+
+	if _, ok := lookupJob(id); ok {
+		t.Errorf("the job is still active after its last task reported back")
+	}
+}
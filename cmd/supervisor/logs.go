@@ -0,0 +1,242 @@
+/**
+ * This file contains the supervisor's logs of what tasks output.
+ *
+ * Workers send the lines a task outputs while it runs. They are appended to
+ * a file for the job in the state directory, one json data.LogLine per line,
+ * which a client can read at any time or follow until the job finishes.
+ **/
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	"github.com/showalter/bdws/internal/data"
+)
+
+const LOGS_DIR = "logs"
+
+// -- Global Variables --------------------------------------------------------
+var logsDir string                      /* Set once the state directory is open */
+var logsMutex = &sync.Mutex{}           /* Held while lines are appended to a log */
+var stopFollowing = make(chan struct{}) /* Closed when the server shuts down */
+
+// -- Internal Routines -------------------------------------------------------
+
+/** -- logPath() --------------------------------------------------------------
+ *  Returns where the lines a job's tasks output are kept.
+ *
+ *  @param id  The id of the job
+ ** ------------------------------------------------------------------------ */
+func logPath(id int) string {
+	return filepath.Join(logsDir, strconv.Itoa(id)+".log")
+}
+
+/** -- appendLog() ------------------------------------------------------------
+ *  Appends lines a task output to its job's log and wakes the clients
+ *  following it. Lines are appended whole, so the log only ever ends in the
+ *  middle of one while logsMutex is held.
+ *
+ *  @param active  The job
+ *  @param lines   The lines, with their task id set
+ ** ------------------------------------------------------------------------ */
+func appendLog(active *ActiveJob, lines []data.LogLine) error {
+	var buf bytes.Buffer
+	for _, line := range lines {
+		b, err := data.LogLineToJson(line)
+		if err != nil {
+			return err
+		}
+		buf.Write(append(b, '\n'))
+	}
+
+	logsMutex.Lock()
+	file, err := os.OpenFile(logPath(active.job.Id), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err == nil {
+		_, err = file.Write(buf.Bytes())
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	logsMutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	jobsMutex.Lock()
+	if active.logged != nil {
+		close(active.logged)
+		active.logged = nil
+	}
+	jobsMutex.Unlock()
+	return nil
+}
+
+/** -- logChanged() -----------------------------------------------------------
+ *  Returns a channel that is closed when lines are next appended to a job's
+ *  log, and one that is closed when the job finishes.
+ *
+ *  @param active  The job
+ ** ------------------------------------------------------------------------ */
+func logChanged(active *ActiveJob) (<-chan struct{}, <-chan struct{}) {
+	jobsMutex.Lock()
+	defer jobsMutex.Unlock()
+
+	if active.logged == nil {
+		active.logged = make(chan struct{})
+	}
+	return active.logged, active.done
+}
+
+/** -- copyLog() --------------------------------------------------------------
+ *  Writes the whole lines of a job's log past an offset.
+ *
+ *  @param w       Write the lines into this writer
+ *  @param id      The id of the job
+ *  @param offset  Where in the log to start
+ *  @return The number of bytes written
+ ** ------------------------------------------------------------------------ */
+func copyLog(w io.Writer, id int, offset int64) (int64, error) {
+	logsMutex.Lock()
+	info, err := os.Stat(logPath(id))
+	logsMutex.Unlock()
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	if info.Size() <= offset {
+		return 0, nil
+	}
+
+	file, err := os.Open(logPath(id))
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	return io.Copy(w, io.NewSectionReader(file, offset, info.Size()-offset))
+}
+
+/** -- serveLog() -------------------------------------------------------------
+ *  Writes a job's log to a client and, if the job is being followed, the
+ *  lines appended to it after, until the job finishes or the client goes
+ *  away.
+ *
+ *  @param w       Write the reply into this writer
+ *  @param r       Information about the request
+ *  @param id      The id of the job
+ *  @param active  The job to follow, or nil to write what is logged so far
+ ** ------------------------------------------------------------------------ */
+func serveLog(w http.ResponseWriter, r *http.Request, id int, active *ActiveJob) {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	flusher, _ := w.(http.Flusher)
+
+	var offset int64
+	for {
+		/* Start waiting before reading, so no lines are missed in between */
+		var changed, done <-chan struct{}
+		if active != nil {
+			changed, done = logChanged(active)
+		}
+
+		n, err := copyLog(w, id, offset)
+		offset += n
+		if err != nil {
+			fmt.Printf("[Supervisor] Could not send the log of job %d: %v\n", id, err)
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+
+		if active == nil {
+			return
+		}
+		select {
+		case <-changed:
+		case <-done:
+			/* Send what came in last and stop */
+			active = nil
+		case <-r.Context().Done():
+			return
+		case <-stopFollowing:
+			return
+		}
+	}
+}
+
+/** -- logsHandler() ----------------------------------------------------------
+ *  Handles the lines tasks output.
+ *
+ *  POST /jobs/{id}/logs/{task id}   Append lines a task output, sent by its
+ *                                   worker as a json list
+ *  GET /jobs/{id}/logs              The lines the job's tasks have output, as
+ *                                   json, one line per line
+ *  GET /jobs/{id}/logs?follow=true  Those and the lines that follow, until
+ *                                   the job finishes
+ *
+ *  @param w      Write the reply into this writer
+ *  @param r      Information about the request
+ *  @param id     The id of the job
+ *  @param parts  The path of the request after /jobs/
+ ** ------------------------------------------------------------------------ */
+func logsHandler(w http.ResponseWriter, r *http.Request, id int, parts []string) {
+	active, ok := lookupJob(id)
+
+	switch {
+	case r.Method == http.MethodPost && len(parts) == 3:
+		if !ok {
+			replyError(w, http.StatusNotFound, fmt.Sprintf("no job with id %d", id))
+			return
+		}
+		if !validTaskId(id, parts[2]) {
+			replyError(w, http.StatusBadRequest, "invalid task id")
+			return
+		}
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			replyError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		lines, err := data.JsonToLogLines(body)
+		if err != nil {
+			rejectMessage(w, "lines", err)
+			return
+		}
+		for i := range lines {
+			if !data.ValidStream(lines[i].Stream) {
+				replyError(w, http.StatusBadRequest, "invalid stream "+lines[i].Stream)
+				return
+			}
+			lines[i].TaskId = parts[2]
+		}
+		if err := appendLog(active, lines); err != nil {
+			fmt.Printf("[Supervisor] Could not log the output of task %s: %v\n", parts[2], err)
+			replyError(w, http.StatusInternalServerError, err.Error())
+		}
+
+	case r.Method == http.MethodGet && len(parts) == 2:
+		if !ok && !archived(id) {
+			replyError(w, http.StatusNotFound, fmt.Sprintf("no job with id %d", id))
+			return
+		}
+		if !ok || r.URL.Query().Get("follow") != "true" {
+			active = nil
+		}
+		serveLog(w, r, id, active)
+
+	case len(parts) <= 3:
+		replyError(w, http.StatusMethodNotAllowed, "method not allowed")
+	default:
+		replyError(w, http.StatusNotFound, "not found")
+	}
+}
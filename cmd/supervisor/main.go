@@ -7,7 +7,8 @@
  * the task can be reinserted into the queue and completed by another worker, or
  * the same worker if it rejoins.
  *
- * Multiple jobs can now be queued up to be completed one after another.
+ * Multiple jobs can now be queued up, and several run at once with their tasks
+ * interleaved by a scheduling policy (see scheduler.go).
  *
  * @author Jacob Bringham, Raleigh Martin, Parth Parikh
  * @version 4/16/2022
@@ -31,8 +32,11 @@ import (
 	// "context"
 	// "container/list"
 	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"io/ioutil"
+	"math"
 	"net/http"
 	"syscall"
 
@@ -42,6 +46,9 @@ import (
 	// "strings"
 
 	"os/signal"
+	"regexp"
+	"sort"
+	"strings"
 	"sync"
 
 	"time"
@@ -49,16 +56,27 @@ import (
 	"github.com/showalter/bdws/internal/data"
 )
 
-const MAX_WORKERS = 1000
+const MAX_WORKERS = 1000 /* Most workers an unparameterized job runs on */
+const MAX_TASKS = 100000 /* Most tasks a job is split into, counting every run */
+const MAX_CORES = 64     /* Most tasks a single worker is given at once */
+
+const DEFAULT_TIMEOUT = time.Hour    /* Time limit of tasks whose job does not set one */
+const LEASE_GRACE = 10 * time.Second /* Time the worker gets past the lease's allowances to report back */
+const KILL_TIMEOUT = 5 * time.Second /* Time to wait for a worker to acknowledge a kill */
+const MAX_REQUEUES = 10              /* Infrastructure failures a task survives before it fails */
+const DEFAULT_MAX_OUTPUT = 64 << 20  /* Bytes of stdout and of stderr kept of tasks whose job does not say */
 
 // -- Internal Structs --------------------------------------------------------
 
 /**
- * A worker an its associated mutex.
+ * A slot on a worker and a context that is cancelled when the worker is
+ * evicted. A worker has one slot in the pool per core, so it is given up to
+ * that many tasks at once.
  **/
 type ProtectedWorker struct {
 	worker data.Worker
-	mutex  *sync.Mutex
+	reg    data.Registration
+	ctx    context.Context
 }
 
 /**
@@ -68,42 +86,311 @@ type Task struct {
 	JobId         int
 	FileName      string
 	Extension     string
-	Code          []byte
+	CodeHash      string /* Workers fetch the code itself from /code/<hash> */
+	Bundle        string /* Archive format of the code, if it is several files */
+	Outputs       []string
+	Limits        data.Limits
 	Parameterized bool
 	Parameter     int
 	Args          []string
+	Timeout       time.Duration
+	Retry         data.RetryPolicy
+	Index         int /* Position of the task within its job */
+	Attempt       int /* Starts at 1, only application failures use up attempts */
+	Requeues      int /* Times the task was requeued after an infrastructure failure */
+	job           *ActiveJob
 }
 
 // -- Global Variables --------------------------------------------------------
 var server *http.Server
-var workers = make(chan ProtectedWorker, MAX_WORKERS)
 
-var jobChannel = make(chan data.Job, MAX_WORKERS)
-var jobDone = make(chan []string, 10) /* Signals completion of tasks */
 var jobsCompleted = 0
 
-var taskChannel = make(chan Task, MAX_WORKERS)
-var taskResults = make(chan string, MAX_WORKERS)
+var jobEncoding = data.EncodingBinaryGzip /* Preferred encoding of tasks sent to workers */
 
 // -- Internal Routines -------------------------------------------------------
 
+/** -- taskId() ---------------------------------------------------------------
+ *  Names an attempt of a task so a worker can find it again.
+ *
+ *  @param task  The task
+ *  @return The id of the task's current attempt
+ ** ------------------------------------------------------------------------ */
+func taskId(task Task) string {
+	return fmt.Sprintf("%d.%d.%d", task.JobId, task.Index, task.Attempt)
+}
+
+/** -- newResult() ------------------------------------------------------------
+ *  Starts the result of a task that has no result from its worker.
+ *
+ *  @param task     The task
+ *  @param pWorker  The worker it was dispatched to
+ *  @return A result that says which task it belongs to
+ ** ------------------------------------------------------------------------ */
+func newResult(task Task, pWorker ProtectedWorker) data.TaskResult {
+	return data.TaskResult{
+		JobId:         task.JobId,
+		TaskId:        taskId(task),
+		Parameterized: task.Parameterized,
+		Parameter:     task.Parameter,
+		Attempt:       task.Attempt,
+		Worker:        pWorker.worker.Hostname,
+	}
+}
+
+/** -- chooseEncoding() -------------------------------------------------------
+ *  Picks the encoding to send a worker its tasks in: the supervisor's
+ *  preferred encoding if the worker accepts it, otherwise the next most
+ *  compact encoding it accepts, and json as a last resort.
+ *
+ *  @param reg  The worker's registration
+ *  @return One of data.Encodings
+ ** ------------------------------------------------------------------------ */
+func chooseEncoding(reg data.Registration) string {
+	preferred := false
+	for _, encoding := range data.Encodings {
+		preferred = preferred || encoding == jobEncoding
+		if !preferred {
+			continue
+		}
+		for _, accepted := range reg.Encodings {
+			if accepted == encoding {
+				return encoding
+			}
+		}
+	}
+	return data.EncodingJson
+}
+
+/** -- packedCode() -----------------------------------------------------------
+ *  Returns a job's code gzip compressed for the workers that fetch it,
+ *  compressing it the first time it is needed.
+ *
+ *  @param active  The job
+ *  @return The packed code, or nil if it could not be packed
+ ** ------------------------------------------------------------------------ */
+func packedCode(active *ActiveJob) []byte {
+	active.packOnce.Do(func() {
+		packed, err := data.PackCode(active.job.Code)
+		if err != nil {
+			fmt.Printf("[Supervisor] Could not compress the code of job %d: %v\n", active.job.Id, err)
+			return
+		}
+		active.packed = packed
+	})
+	return active.packed
+}
+
+/** -- requeue() --------------------------------------------------------------
+ *  Puts a task back into the task queue without blocking the caller.
+ *
+ *  @param task   The task to requeue
+ *  @param delay  How long to wait before the task may run again
+ ** ------------------------------------------------------------------------ */
+func requeue(task Task, delay time.Duration) {
+	taskRequeued(task)
+	time.AfterFunc(delay, func() { pushTask(task) })
+}
+
+/** -- killTask() -------------------------------------------------------------
+ *  Tells a worker to kill the process of a task whose lease expired or whose
+ *  job was cancelled.
+ *
+ *  @param task     The task to kill
+ *  @param pWorker  The worker running the task
+ ** ------------------------------------------------------------------------ */
+func killTask(task Task, pWorker ProtectedWorker) {
+	ctx, cancel := context.WithTimeout(pWorker.ctx, KILL_TIMEOUT)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "POST",
+		"http://"+pWorker.worker.Hostname+"/kill", bytes.NewReader([]byte(taskId(task))))
+	if err != nil {
+		/* The worker cannot be reached at the address it gave */
+		evictWorker(pWorker.worker.Id, err.Error())
+		return
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		fmt.Printf("[Supervisor] Could not kill task %s on %s: %v\n",
+			taskId(task), pWorker.worker.Hostname, err)
+		return
+	}
+	resp.Body.Close()
+}
+
+/** -- shouldRetry() ----------------------------------------------------------
+ *  Decides whether a task that failed in its own right gets another attempt.
+ *
+ *  @param task      The task that failed
+ *  @param exitCode  The exit code of the task
+ *  @param timedOut  Whether the task ran past its time limit
+ *  @return TRUE if the task should run again
+ ** ------------------------------------------------------------------------ */
+func shouldRetry(task Task, exitCode int, timedOut bool) bool {
+	policy := task.Retry
+
+	maxAttempts := policy.MaxAttempts
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+	if task.Attempt >= maxAttempts {
+		return false
+	}
+
+	/* Exit code filters do not apply to tasks that were killed for time */
+	if timedOut {
+		return true
+	}
+
+	for _, code := range policy.NeverRetryOn {
+		if code == exitCode {
+			return false
+		}
+	}
+
+	if len(policy.RetryOn) == 0 {
+		return true
+	}
+	for _, code := range policy.RetryOn {
+		if code == exitCode {
+			return true
+		}
+	}
+	return false
+}
+
+/** -- backoff() --------------------------------------------------------------
+ *  Returns how long to wait before the next attempt of a task: the job's
+ *  backoff before the second attempt, doubled for every attempt after it
+ *  until it is an hour or more.
+ *
+ *  @param task  The task about to be retried, with its next attempt number
+ ** ------------------------------------------------------------------------ */
+func backoff(task Task) time.Duration {
+	delay := task.Retry.Backoff
+	for i := 2; i < task.Attempt && delay > 0 && delay < time.Hour; i++ {
+		delay *= 2
+	}
+	return delay
+}
+
+/** -- applicationFailure() ---------------------------------------------------
+ *  Retries a task that exited non-zero or ran past its time limit, or fails
+ *  it according to its job's retry policy.
+ *
+ *  @param task      The task that failed
+ *  @param pWorker   The worker it ran on
+ *  @param result    Whatever the worker sent back
+ *  @param timedOut  Whether the task ran past its time limit
+ ** ------------------------------------------------------------------------ */
+func applicationFailure(task Task, pWorker ProtectedWorker, result data.TaskResult, timedOut bool) {
+	if timedOut {
+		fmt.Printf("[Supervisor] Task %s timed out on %s.\n", taskId(task), pWorker.worker.Hostname)
+		result.Note = fmt.Sprintf("Task timed out after %v on attempt %d", task.Timeout, task.Attempt)
+	} else if result.Limit != "" {
+		fmt.Printf("[Supervisor] Task %s went over its %s limit on %s.\n",
+			taskId(task), result.Limit, pWorker.worker.Hostname)
+		result.Note = fmt.Sprintf("Task was killed for going over its %s limit on attempt %d",
+			result.Limit, task.Attempt)
+	} else {
+		fmt.Printf("[Supervisor] Task %s exited with %d on %s.\n",
+			taskId(task), result.ExitCode, pWorker.worker.Hostname)
+	}
+
+	if shouldRetry(task, result.ExitCode, timedOut) {
+		task.Attempt++
+		requeue(task, backoff(task))
+		return
+	}
+
+	result.Failed = true
+	result.Failure = data.FailureApplication
+	taskFinished(task, result)
+}
+
+/** -- infrastructureFailure() ------------------------------------------------
+ *  Requeues a task whose worker died, could not be reached or is shutting
+ *  down, and stops dispatching to the worker. These failures do not use up
+ *  the task's attempts, but a task that keeps taking workers down is failed
+ *  after MAX_REQUEUES.
+ *
+ *  @param task     The task that was lost
+ *  @param pWorker  The worker it was dispatched to
+ *  @param err      What went wrong
+ ** ------------------------------------------------------------------------ */
+func infrastructureFailure(task Task, pWorker ProtectedWorker, err error) {
+	evictWorker(pWorker.worker.Id, err.Error())
+	taskRejected(task, pWorker, err)
+}
+
+/** -- taskRejected() ---------------------------------------------------------
+ *  Requeues a task that a worker could not run, e.g. because it could not
+ *  fetch the task's code, without giving up on the worker. The task is
+ *  failed after MAX_REQUEUES.
+ *
+ *  @param task     The task
+ *  @param pWorker  The worker it was dispatched to
+ *  @param err      What went wrong
+ ** ------------------------------------------------------------------------ */
+func taskRejected(task Task, pWorker ProtectedWorker, err error) {
+	if task.Requeues < MAX_REQUEUES {
+		task.Requeues++
+		requeue(task, 0)
+		return
+	}
+
+	failTask(task, pWorker, fmt.Sprintf("Task was lost %d times, last on %s: %v",
+		task.Requeues+1, pWorker.worker.Hostname, err))
+}
+
+/** -- failTask() -------------------------------------------------------------
+ *  Fails a task for a reason that has nothing to do with its program.
+ *
+ *  @param task     The task
+ *  @param pWorker  The worker it was dispatched to
+ *  @param note     Why the task failed, for the client
+ ** ------------------------------------------------------------------------ */
+func failTask(task Task, pWorker ProtectedWorker, note string) {
+	result := newResult(task, pWorker)
+	result.ExitCode = -1
+	result.Failed = true
+	result.Failure = data.FailureInfrastructure
+	result.Note = note
+	taskFinished(task, result)
+}
+
 /** -- dispatch() -------------------------------------------------------------
- *  Dispatches a task to a worker.
+ *  Dispatches a task to a worker and returns the worker's slot to the pool
+ *  once the task is done.
+ *
+ *  The task is leased to the worker for its time limit, plus the time the
+ *  worker may spend fetching its code and uploading what it output, plus
+ *  LEASE_GRACE. If the lease expires the request is cancelled, the worker is
+ *  told to kill the task, and the task is retried or failed.
  * @param task  The task to dispatch
  * @param pWorker  The worker to dispatch the task to
  ** ------------------------------------------------------------------------ */
 func dispatch(task Task, pWorker ProtectedWorker) {
-	fmt.Println("[Supervisor] Dispatching task.")
+	fmt.Printf("[Supervisor] Dispatching task %s.\n", taskId(task))
 
-	/* Package and send the task to the worker */
-	pWorker.mutex.Lock()
+	/* Package and send the task to the worker, unless its job was just cancelled */
+	if !taskStarted(task, pWorker) {
+		releaseSlot(pWorker)
+		return
+	}
 
 	end := task.Parameter - 1
 	if task.Parameterized {
 		end = task.Parameter + 1
 	}
 
-	jobBytes := data.JobToJson(data.Job{
+	/* Send the task in the most compact encoding the worker accepts, with
+	 * only the hash of its code; the worker fetches code it has not cached */
+	encoding := chooseEncoding(pWorker.reg)
+
+	encoded, err := data.EncodeJob(data.Job{
 		Id:             task.JobId,
 		Time:           time.Now(),
 		Machines:       1,
@@ -111,109 +398,292 @@ func dispatch(task Task, pWorker ProtectedWorker) {
 		ParameterEnd:   end,
 		FileName:       task.FileName,
 		Extension:      task.Extension,
-		Code:           task.Code,
+		CodeHash:       task.CodeHash,
+		Bundle:         task.Bundle,
+		Outputs:        task.Outputs,
+		Limits:         task.Limits,
 		Args:           task.Args,
 		Nruns:          1,
-	})
-
-	/* Launch an asyncronous post request and cancel if it stops responding */
-	/*
-		context, cancelChannel := context.WithCancel(Context.Background())
+		Timeout:        task.Timeout,
+		TaskId:         taskId(task),
+		Attempt:        task.Attempt,
+	}, encoding, nil)
+	if err != nil {
+		/* Another worker would not do better */
+		failTask(task, pWorker, fmt.Sprintf("Task could not be encoded: %v", err))
+		releaseSlot(pWorker)
+		return
+	}
 
-		req, _ = http.NewRequestWithContext(context, "POST",
-			"http://" + pWorker.worker.Hostname + "/newjob",
-			 bytes.NewReader(jobBytes))
+	/* Post the task to the worker; the request is cancelled if the worker is
+	 * evicted or the lease expires */
+	lease := data.FetchTimeout + task.Timeout + data.UploadTimeout + LEASE_GRACE
+	ctx, cancel := context.WithTimeout(pWorker.ctx, lease)
+	defer cancel()
 
-		req.Header.Add("Content-Type", "application/json")
-	*/
+	req, err := http.NewRequestWithContext(ctx, "POST",
+		"http://"+pWorker.worker.Hostname+"/newjob", encoded.Body)
+	if err != nil {
+		/* The worker cannot be reached at the address it gave */
+		infrastructureFailure(task, pWorker, err)
+		return
+	}
+	req.Header.Add("Content-Type", encoded.ContentType)
+	if encoded.ContentEncoding != "" {
+		req.Header.Add("Content-Encoding", encoded.ContentEncoding)
+	}
 
-	resp, err := http.Post("http://"+pWorker.worker.Hostname+"/newjob",
-		"text/plain", bytes.NewReader(jobBytes))
+	resp, err := http.DefaultClient.Do(req)
 
+	result := newResult(task, pWorker)
+	buf := new(bytes.Buffer)
 	if err == nil {
+		/* Read the result the worker sent back */
+		_, err = buf.ReadFrom(resp.Body)
+		resp.Body.Close()
+
+		if err == nil && (resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusGatewayTimeout) {
+			if decoded, jsonErr := data.JsonToTaskResult(buf.Bytes()); jsonErr != nil {
+				err = fmt.Errorf("worker sent a malformed result: %v", jsonErr)
+			} else {
+				result = decoded
+			}
+		}
+	}
+
+	switch {
+	case err == nil && resp.StatusCode == http.StatusOK && result.ExitCode == 0:
+		taskFinished(task, result)
+
+	case cancelled(task.job):
+		/* Keep whatever the task printed before it was killed */
+		result.Failed = true
+		result.Failure = data.FailureCancelled
+		result.Note = "Job was cancelled"
+		taskFinished(task, result)
+
+	case err == nil && resp.StatusCode == http.StatusGatewayTimeout:
+		/* The worker enforced the time limit itself */
+		applicationFailure(task, pWorker, result, true)
+
+	case err == nil && resp.StatusCode != http.StatusOK:
+		reason := fmt.Errorf("worker replied %s", resp.Status)
+		if reply, jsonErr := data.JsonToError(buf.Bytes()); jsonErr == nil && reply.Error != "" {
+			reason = fmt.Errorf("worker replied %s: %s", resp.Status, reply.Error)
+		}
+		if resp.StatusCode == http.StatusServiceUnavailable {
+			/* The worker is shutting down and takes no more tasks */
+			infrastructureFailure(task, pWorker, reason)
+		} else {
+			/* The worker could not take this task, e.g. it failed to fetch
+			 * the code, but its other tasks are fine */
+			taskRejected(task, pWorker, reason)
+		}
 
-		/* Put the bytes from the request into a file */
-		buf := new(bytes.Buffer)
-		buf.ReadFrom(resp.Body)
-		result := buf.String()
-		taskResults <- result
+	case err == nil:
+		applicationFailure(task, pWorker, result, false)
 
-	} else {
-		/* If the request failed, put the task back in the queue */
-		taskChannel <- task
+	case alive(pWorker) && ctx.Err() == context.DeadlineExceeded:
+		/* The lease expired before the worker answered */
+		killTask(task, pWorker)
+		result.ExitCode = -1
+		applicationFailure(task, pWorker, result, true)
 
-		/* Yield so another worker can maybe get the request */
-		time.Sleep(time.Millisecond * 250)
+	default:
+		/* The worker is unreachable, so stop dispatching to it and put the task back in the queue */
+		infrastructureFailure(task, pWorker, err)
 	}
 
-	pWorker.mutex.Unlock()
+	/* Make the slot available for another task */
+	if alive(pWorker) {
+		releaseSlot(pWorker)
+	}
 }
 
 /** - taskManager() ----------------------------------------------------------
- *  Handles task queue.
+ *  Dispatches tasks to free worker slots as the scheduler pairs them up.
  ** ------------------------------------------------------------------------ */
 func taskManager() {
 	for {
-
-		task := <-taskChannel
-		worker := <-workers
+		task, worker := nextAssignment()
 
 		/* Dispatch the task to the worker */
-		dispatch(task, worker)
+		go dispatch(task, worker)
 	}
 }
 
-/** -- supervisor() ----------------------------------------------------------
- *  Splits jobs in the job channel into tasks and places them in the task
- *  queue.
+/** -- countTasks() -----------------------------------------------------------
+ *  Works out how many tasks a job is split into, without overflowing on
+ *  ranges and run counts no supervisor could hold. An unparameterized job
+ *  runs on fewer workers than it is given if it would otherwise have more
+ *  than MAX_TASKS tasks.
+ *
+ *  @param job       The job
+ *  @param nWorkers  The number of workers an unparameterized job runs on
+ *  @return The number of tasks, or an error if there would be more than
+ *          MAX_TASKS
  ** ------------------------------------------------------------------------ */
-func supervisor() {
-	/* Infinitely handle jobs from the job channel */
-	for true {
-		job := <-jobChannel
-		fmt.Println("[Supervisor] Received a job.")
-
-		start := 0
-		end := 0
-		step := 1
-		param := false
-
-		/* If the job is parameterized, make that many tasks */
-		if job.ParameterEnd < job.ParameterStart {
-			start = job.ParameterStart
-			end = job.ParameterEnd
-			param = true
-		} else { /* Otherwise, run one on every currently available worker */
-			start = 0
-			end = len(workers)
+func countTasks(job data.Job, nWorkers int) (int, error) {
+	runs := job.Nruns
+	if runs < 1 {
+		runs = 1
+	}
+	if runs > MAX_TASKS {
+		return 0, fmt.Errorf("job would be split into more than %d tasks", MAX_TASKS)
+	}
+
+	if job.ParameterEnd < job.ParameterStart {
+		width := nWorkers
+		if width > MAX_WORKERS {
+			width = MAX_WORKERS
+		}
+		if width > MAX_TASKS/runs {
+			width = MAX_TASKS / runs
 		}
+		if width < 1 {
+			width = 1
+		}
+		return runs * width, nil
+	}
+
+	/* Unsigned, the difference cannot overflow */
+	span := uint64(job.ParameterEnd) - uint64(job.ParameterStart)
+	if span >= MAX_TASKS || runs > MAX_TASKS/(int(span)+1) {
+		return 0, fmt.Errorf("job would be split into more than %d tasks", MAX_TASKS)
+	}
+	return runs * (int(span) + 1), nil
+}
+
+/** -- splitJob() -------------------------------------------------------------
+ *  Splits a job into tasks.
+ *
+ *  @param active    The job
+ *  @param nWorkers  The number of workers an unparameterized job runs on
+ *  @return The tasks of the job
+ ** ------------------------------------------------------------------------ */
+func splitJob(active *ActiveJob, nWorkers int) []Task {
+	job := active.job
+
+	start := 0
+	end := 0
+	step := 1
+	param := false
+
+	runs := job.Nruns
+	if runs < 1 {
+		runs = 1
+	}
+
+	/* job() made sure the tasks are not too many */
+	nTasks, _ := countTasks(job, nWorkers)
+
+	/* If the job is parameterized, make that many tasks */
+	if job.ParameterEnd >= job.ParameterStart {
+		start = job.ParameterStart
+		end = job.ParameterEnd
+		param = true
+	} else { /* Otherwise, run one on every given worker */
+		start = 0
+		end = nTasks/runs - 1
+	}
+
+	timeout := job.Timeout
+	if timeout <= 0 {
+		timeout = DEFAULT_TIMEOUT
+	}
+	limits := job.Limits
+	if limits.Output <= 0 {
+		limits.Output = DEFAULT_MAX_OUTPUT
+	}
 
-		/* Insert the tasks into the task channel */
+	/* Make the tasks, once for every run */
+	tasks := make([]Task, 0, nTasks)
+	for run := 0; run < runs; run++ {
 		for i := start; i <= end; i += step {
-			task := Task{
+			tasks = append(tasks, Task{
 				JobId:         job.Id,
 				FileName:      job.FileName,
 				Extension:     job.Extension,
-				Code:          job.Code,
+				CodeHash:      job.CodeHash,
+				Bundle:        job.Bundle,
+				Outputs:       job.Outputs,
+				Limits:        limits,
 				Parameterized: param,
 				Parameter:     i,
 				Args:          job.Args,
-			}
-			taskChannel <- task
+				Timeout:       timeout,
+				Retry:         job.Retry,
+				Index:         len(tasks),
+				Attempt:       1,
+				job:           active,
+			})
 		}
+	}
 
-		/* Wait until all tasks are completed */
-		for true {
-			if len(taskResults) == start-end {
-				break
-			}
-			time.Sleep(time.Second)
-			fmt.Println("[Supervisor] Waiting for tasks to complete.")
-		}
+	return tasks
+}
 
+/** -- supervisor() ----------------------------------------------------------
+ *  Takes jobs from the job queue, highest priority first, and makes their
+ *  tasks available to the task manager. Up to MAX_ACTIVE_JOBS jobs run at
+ *  once; completion is tracked per job as results come in.
+ ** ------------------------------------------------------------------------ */
+func supervisor() {
+	/* Infinitely handle jobs from the job queue */
+	for true {
+		activeSlots <- struct{}{}
+		active := nextJob()
+		fmt.Printf("[Supervisor] Starting job %d.\n", active.job.Id)
+
+		/* Run an unparameterized job on every available worker that fits it */
+		tasks := splitJob(active, countWorkers(active))
+		activateJob(active, len(tasks), tasks)
 	}
 }
 
+/** -- formatResults() --------------------------------------------------------
+ *  Encodes the results of a job's tasks for the client. Results are ordered
+ *  by parameter so the output of a sweep reads in order.
+ *
+ *  @param results  The task results to encode
+ *  @return The results as json
+ ** ------------------------------------------------------------------------ */
+func formatResults(results []data.TaskResult) ([]byte, error) {
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].Parameter < results[j].Parameter
+	})
+	return data.TaskResultsToJson(results)
+}
+
+/** -- checkJob() -------------------------------------------------------------
+ *  Checks that a job can be run, when it is submitted and again when it is
+ *  replayed from the log.
+ *
+ *  @param job  The job
+ *  @return The job's compiled CPU model requirement, or why it cannot run
+ ** ------------------------------------------------------------------------ */
+func checkJob(job data.Job) (*regexp.Regexp, error) {
+	modelPattern, err := regexp.Compile(job.Requires.CpuModel)
+	if err != nil {
+		return nil, errors.New("invalid CPU model pattern: " + err.Error())
+	}
+	if !data.ValidBundle(job.Bundle) {
+		return nil, errors.New("unknown bundle format " + job.Bundle)
+	}
+	if l := job.Limits; l.CpuTime < 0 || l.Memory < 0 || l.OpenFiles < 0 || l.Processes < 0 || l.Output < 0 {
+		return nil, errors.New("resource limits cannot be negative")
+	}
+	for _, pattern := range job.Outputs {
+		if err := data.CheckOutputPattern(pattern); err != nil {
+			return nil, errors.New("invalid output pattern " + err.Error())
+		}
+	}
+	if _, err := countTasks(job, 1); err != nil {
+		return nil, err
+	}
+	return modelPattern, nil
+}
+
 /** -- job() ------------------------------------------------------------------
  *  Handles a job request.
  *  @param w  Write the reply into this writer
@@ -224,23 +694,40 @@ func job(w http.ResponseWriter, r *http.Request) {
 
 	/* Parse the HTTP Request */
 	if err := r.ParseForm(); err != nil {
-		panic(err)
+		replyError(w, http.StatusBadRequest, err.Error())
+		return
 	}
 
-	buf, err := ioutil.ReadAll(r.Body)
+	/* Jobs that say up front they are too large are refused. The body may
+	   have a byte more than a job, so that decoding is what finds the job
+	   too large */
+	if r.ContentLength > data.MaxJobSize {
+		replyError(w, http.StatusRequestEntityTooLarge,
+			fmt.Sprintf("job is larger than the %d bytes the supervisor accepts", int64(data.MaxJobSize)))
+		return
+	}
+	body := http.MaxBytesReader(w, r.Body, data.MaxJobSize+1)
+
+	job, err := data.DecodeJob(body, r.Header.Get("Content-Type"), r.Header.Get("Content-Encoding"))
 	if err != nil {
-		panic(err)
+		rejectMessage(w, "job", err)
+		return
 	}
 
-	job := data.JsonToJob(buf)
+	/* Only jobs that can run make it into the log */
+	modelPattern, err := checkJob(job)
+	if err != nil {
+		replyError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	active := addJob(job, modelPattern)
 
-	runs := job.Nruns
-	job.Nruns = 1
+	/* Queue the job and reply with its id right away */
+	enqueueJob(active)
+	fmt.Printf("[Supervisor] Queued job %d.\n", active.job.Id)
 
-	/* Send the job to the job channel N times */
-	for i := 0; i < runs; i++ {
-		jobChannel <- job
-	}
+	reply, err := data.JobStatusToJson(jobStatus(active))
+	replyJson(w, reply, err)
 }
 
 /** -- register() -------------------------------------------------------------
@@ -254,24 +741,115 @@ func register(w http.ResponseWriter, r *http.Request) {
 
 	/* Parse the HTTP Request */
 	if err := r.ParseForm(); err != nil {
-		panic(err)
+		replyError(w, http.StatusBadRequest, err.Error())
+		return
 	}
 
 	buf, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		panic(err)
+		replyError(w, http.StatusBadRequest, err.Error())
+		return
 	}
 
-	reg := data.JsonToRegistration(buf)
+	reg, err := data.JsonToRegistration(buf)
+	if err != nil {
+		rejectMessage(w, "registration", err)
+		return
+	}
 	fmt.Printf("%+v\n", reg)
 
-	/* Create the worker struct and append it to the queue */
-	worker := data.Worker{Id: 0, Busy: false, Hostname: reg.Hostname}
-	protectedWorker := ProtectedWorker{worker, &sync.Mutex{}}
-	workers <- protectedWorker
+	/* A worker is sent tasks and replies in this supervisor's version, so it
+	 * has to speak exactly that one or it would take slots it cannot use */
+	if reg.Version != data.ProtocolVersion {
+		rejectMessage(w, "registration", &data.VersionError{Version: reg.Version})
+		return
+	}
+
+	/* Tasks are sent to the address the worker registers with */
+	if err := checkHostname(reg.Hostname); err != nil {
+		replyError(w, http.StatusBadRequest, "invalid hostname: "+err.Error())
+		return
+	}
+
+	/* Create the worker struct and give it one slot in the queue per core */
+	protectedWorker := addWorker(reg)
+
+	cores := reg.Cores
+	if cores < 1 {
+		cores = 1
+	} else if cores > MAX_CORES {
+		cores = MAX_CORES
+	}
+	for i := 0; i < cores; i++ {
+		releaseSlot(protectedWorker)
+	}
 
 	/* Send a response to the worker  */
-	w.Write(data.WorkerToJson(worker))
+	reply, err := data.WorkerToJson(protectedWorker.worker)
+	replyJson(w, reply, err)
+}
+
+/** -- replyError() -----------------------------------------------------------
+ *  Answers a request that could not be handled with a json error body.
+ *
+ *  @param w        Write the reply into this writer
+ *  @param code     The HTTP status code
+ *  @param message  What went wrong
+ ** ------------------------------------------------------------------------ */
+func replyError(w http.ResponseWriter, code int, message string) {
+	reply, err := data.ErrorToJson(data.Error{Error: message})
+	if err != nil {
+		http.Error(w, message, code)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(reply)
+}
+
+/** -- rejectMessage() --------------------------------------------------------
+ *  Answers a request whose body could not be decoded. Messages from a binary
+ *  that speaks another protocol version get 426 so the sender knows to
+ *  upgrade, bodies in an encoding this supervisor does not understand get
+ *  415 and jobs that are too large 413; anything else is a bad request.
+ *
+ *  @param w     Write the reply into this writer
+ *  @param what  What the body should have been
+ *  @param err   The error from decoding the body
+ ** ------------------------------------------------------------------------ */
+func rejectMessage(w http.ResponseWriter, what string, err error) {
+	var versionErr *data.VersionError
+	if errors.As(err, &versionErr) {
+		fmt.Printf("[Supervisor] Rejected a %s: %v\n", what, err)
+		replyError(w, http.StatusUpgradeRequired, what+" rejected: "+err.Error())
+		return
+	} else if errors.Is(err, data.ErrUnsupportedEncoding) {
+		replyError(w, http.StatusUnsupportedMediaType, what+" rejected: "+err.Error())
+		return
+	} else if errors.Is(err, data.ErrJobTooLarge) {
+		replyError(w, http.StatusRequestEntityTooLarge, what+" rejected: "+err.Error())
+		return
+	}
+	replyError(w, http.StatusBadRequest, "invalid "+what+": "+err.Error())
+}
+
+/** -- replyJson() ------------------------------------------------------------
+ *  Answers a request with a json body, or with an error if it could not be
+ *  encoded.
+ *
+ *  @param w      Write the reply into this writer
+ *  @param reply  The encoded reply
+ *  @param err    The error from encoding the reply
+ ** ------------------------------------------------------------------------ */
+func replyJson(w http.ResponseWriter, reply []byte, err error) {
+	if err != nil {
+		replyError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(reply)
 }
 
 /** -- usage() ----------------------------------------------------------------
@@ -280,7 +858,8 @@ func register(w http.ResponseWriter, r *http.Request) {
  *  @param args Command line arguments
  ** ------------------------------------------------------------------------ */
 func usage(args []string) {
-	fmt.Printf("Usage: %s <port>\n", args[0])
+	fmt.Printf("Usage: %s [flags] <port>\n", args[0])
+	flag.PrintDefaults()
 }
 
 /** -- shutdown() -------------------------------------------------------------
@@ -297,19 +876,62 @@ func shutdown(sig os.Signal) {
 func main() {
 
 	/* Parse command line arguments */
-	var args []string = os.Args
+	policyName := flag.String("policy", "fair", "How tasks of concurrent jobs are interleaved: "+
+		strings.Join(policyNames(), ", "))
+	encodingName := flag.String("encoding", data.EncodingBinaryGzip, "Preferred encoding of tasks sent to workers: "+
+		strings.Join(data.Encodings, ", ")+"\nWorkers that do not accept it get the next most compact encoding they do")
+	stateDir := flag.String("state", "supervisor_state",
+		"Directory for the log of submitted jobs and their results, replayed on restart")
+	maxArtifactMB := flag.Int64("max-artifact", DEFAULT_MAX_ARTIFACT>>20, "MB a file output by a task may have")
+	flag.Usage = func() { usage(os.Args) }
+	flag.Parse()
+
+	var args []string = flag.Args()
+
+	if len(args) != 1 {
+		usage(os.Args)
+		os.Exit(1)
+	}
+
+	chosen, ok := policies[*policyName]
+	if !ok {
+		fmt.Printf("Unknown scheduling policy '%s'\n", *policyName)
+		usage(os.Args)
+		os.Exit(1)
+	}
+	policy = chosen
 
-	if len(args) != 2 {
-		usage(args)
+	if !data.ValidEncoding(*encodingName) {
+		fmt.Printf("Unknown encoding '%s'\n", *encodingName)
+		usage(os.Args)
 		os.Exit(1)
 	}
+	jobEncoding = *encodingName
+
+	if *maxArtifactMB < 1 || *maxArtifactMB > math.MaxInt64>>20 {
+		fmt.Printf("Invalid -max-artifact %d\n", *maxArtifactMB)
+		usage(os.Args)
+		os.Exit(1)
+	}
+	maxArtifact = *maxArtifactMB << 20
 
 	port := args[0]
 
+	/* Recover the jobs of a previous run before accepting new ones */
+	if err := openStore(*stateDir); err != nil {
+		fmt.Printf("Could not open the state directory '%s': %v\n", *stateDir, err)
+		os.Exit(1)
+	}
+
 	/* Start the HTTP Server */
 	server = &http.Server{Addr: port}
+	server.RegisterOnShutdown(func() { close(stopFollowing) })
 	http.HandleFunc("/job", job)
+	http.HandleFunc("/jobs/", jobsHandler)
+	http.HandleFunc("/history", historyHandler)
+	http.HandleFunc("/code/", codeHandler)
 	http.HandleFunc("/register", register)
+	http.HandleFunc("/heartbeat", heartbeat)
 
 	done := &sync.WaitGroup{}
 	done.Add(1)
@@ -317,11 +939,12 @@ func main() {
 	/* Install a signal handler to catch SIGINT and SIGTERM and shutdown gracefully */
 	signalChan := make(chan os.Signal, 1)
 	signal.Notify(signalChan, syscall.SIGINT)
-	go shutdown(<-signalChan)
+	go func() { shutdown(<-signalChan) }()
 
 	/* Spawn a thread to handle jobs */
 	go supervisor()
 	go taskManager()
+	go heartbeatMonitor()
 
 	/* Spawn a thread to handle the server */
 	go func() {
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/showalter/bdws/internal/data"
+)
+
+func TestCountTasks(t *testing.T) {
+	tests := []struct {
+		name     string
+		start    int
+		end      int
+		runs     int
+		nWorkers int
+		want     int // 0 if the job is rejected
+	}{
+		{"range", 1, 10, 1, 1, 10},
+		{"runs of a range", 1, 10, 3, 1, 30},
+		{"no runs", 5, 5, 0, 1, 1},
+		{"largest range", 1, MAX_TASKS, 1, 1, MAX_TASKS},
+		{"range too large", 0, MAX_TASKS, 1, 1, 0},
+		{"runs too many", 1, 1000, 101, 1, 0},
+		{"range of every int", math.MinInt64, math.MaxInt64, 1, 1, 0},
+		{"range wider than an int", -1, math.MaxInt64, 1, 1, 0},
+		{"runs times range overflows", 0, 1 << 16, 1 << 48, 1, 0},
+		{"every worker", 0, -1, 2, 8, 16},
+		{"no workers", 0, -1, 1, 0, 1},
+		{"too many workers", 0, -1, 1, 5000, MAX_WORKERS},
+		{"runs limit the workers", 0, -1, MAX_TASKS / 10, 100, MAX_TASKS},
+		{"runs too many on one worker", 0, -1, MAX_TASKS + 1, 1, 0},
+	}
+
+	for _, test := range tests {
+		job := data.Job{ParameterStart: test.start, ParameterEnd: test.end, Nruns: test.runs}
+		got, err := countTasks(job, test.nWorkers)
+		if test.want == 0 {
+			if err == nil {
+				t.Errorf("%s: got %d tasks, want the job rejected", test.name, got)
+			}
+		} else if err != nil || got != test.want {
+			t.Errorf("%s: got %d tasks (%v), want %d", test.name, got, err, test.want)
+		}
+	}
+}
+
+func TestShouldRetry(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   data.RetryPolicy
+		attempt  int
+		exitCode int
+		timedOut bool
+		want     bool
+	}{
+		{"no policy", data.RetryPolicy{}, 1, 1, false, false},
+		{"attempts left", data.RetryPolicy{MaxAttempts: 3}, 1, 1, false, true},
+		{"last attempt", data.RetryPolicy{MaxAttempts: 3}, 3, 1, false, false},
+		{"past the last attempt", data.RetryPolicy{MaxAttempts: 3}, 4, 1, false, false},
+		{"retry on the code", data.RetryPolicy{MaxAttempts: 3, RetryOn: []int{75, 2}}, 1, 2, false, true},
+		{"retry on other codes", data.RetryPolicy{MaxAttempts: 3, RetryOn: []int{75}}, 1, 2, false, false},
+		{"never retry on the code", data.RetryPolicy{MaxAttempts: 3, NeverRetryOn: []int{2}}, 1, 2, false, false},
+		{"never retry on other codes", data.RetryPolicy{MaxAttempts: 3, NeverRetryOn: []int{2}}, 1, 1, false, true},
+		{"never wins over retry", data.RetryPolicy{MaxAttempts: 3, RetryOn: []int{2}, NeverRetryOn: []int{2}}, 1, 2, false, false},
+		{"timed out with attempts left", data.RetryPolicy{MaxAttempts: 2, RetryOn: []int{75}, NeverRetryOn: []int{-1}}, 1, -1, true, true},
+		{"timed out on the last attempt", data.RetryPolicy{MaxAttempts: 2}, 2, -1, true, false},
+	}
+
+	for _, test := range tests {
+		task := Task{Retry: test.policy, Attempt: test.attempt}
+		if got := shouldRetry(task, test.exitCode, test.timedOut); got != test.want {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		name    string
+		backoff time.Duration
+		attempt int // The attempt about to run
+		want    time.Duration
+	}{
+		{"no backoff", 0, 5, 0},
+		{"second attempt", time.Second, 2, time.Second},
+		{"third attempt", time.Second, 3, 2 * time.Second},
+		{"fifth attempt", time.Second, 5, 8 * time.Second},
+		{"stops doubling past an hour", time.Second, 100, 4096 * time.Second},
+		{"long backoff doubles once", 40 * time.Minute, 3, 80 * time.Minute},
+		{"long backoff is capped", 40 * time.Minute, 100, 80 * time.Minute},
+		{"backoff of an hour", time.Hour, 100, time.Hour},
+	}
+
+	for _, test := range tests {
+		task := Task{Retry: data.RetryPolicy{Backoff: test.backoff}, Attempt: test.attempt}
+		if got := backoff(task); got != test.want {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+// Dispatch a task of a running job with two tasks, so it never completes,
+// as if it were on a worker.
+func failingTask(policy data.RetryPolicy) (Task, ProtectedWorker) {
+	active := &ActiveJob{
+		job:      data.Job{Id: 1},
+		status:   data.JobRunning,
+		nTasks:   2,
+		done:     make(chan struct{}),
+		inFlight: make(map[int]dispatched),
+	}
+	return Task{JobId: 1, Retry: policy, Attempt: 1, job: active},
+		ProtectedWorker{worker: data.Worker{Id: -1, Hostname: "worker:1"}}
+}
+
+// Run a failure of a task that was dispatched and return the task it is
+// requeued as, or its result if it is failed instead.
+func failOnce(t *testing.T, task Task, fail func(Task)) (*Task, *data.TaskResult) {
+	jobsMutex.Lock()
+	task.job.running++
+	jobsMutex.Unlock()
+	fail(task)
+
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		jobsMutex.Lock()
+		active := task.job
+		if len(active.pending) > 0 {
+			requeued := active.pending[0]
+			active.pending = active.pending[1:]
+			jobsMutex.Unlock()
+			return &requeued, nil
+		}
+		if len(active.results) > 0 {
+			result := active.results[len(active.results)-1]
+			active.results = nil
+			jobsMutex.Unlock()
+			return nil, &result
+		}
+		jobsMutex.Unlock()
+	}
+	t.Fatal("the task was neither requeued nor failed")
+	return nil, nil
+}
+
+func TestApplicationFailuresUseAttempts(t *testing.T) {
+	task, pWorker := failingTask(data.RetryPolicy{MaxAttempts: 3})
+	exited := func(task Task) {
+		applicationFailure(task, pWorker, data.TaskResult{Attempt: task.Attempt, ExitCode: 1}, false)
+	}
+
+	for attempt := 2; attempt <= 3; attempt++ {
+		requeued, result := failOnce(t, task, exited)
+		if requeued == nil {
+			t.Fatalf("attempt %d: the task failed (%+v), want it retried", attempt-1, *result)
+		}
+		if requeued.Attempt != attempt || requeued.Requeues != 0 {
+			t.Fatalf("got attempt %d after %d requeues, want attempt %d after none",
+				requeued.Attempt, requeued.Requeues, attempt)
+		}
+		task = *requeued
+	}
+
+	_, result := failOnce(t, task, exited)
+	if result == nil || !result.Failed || result.Failure != data.FailureApplication || result.Attempt != 3 {
+		t.Fatalf("got %+v, want an application failure on attempt 3", result)
+	}
+}
+
+func TestInfrastructureFailuresUseRequeues(t *testing.T) {
+	task, pWorker := failingTask(data.RetryPolicy{MaxAttempts: 1})
+	failures := []func(Task){
+		func(task Task) { infrastructureFailure(task, pWorker, errors.New("worker died")) },
+		func(task Task) { taskRejected(task, pWorker, errors.New("code could not be fetched")) },
+	}
+
+	for i := 0; i < MAX_REQUEUES; i++ {
+		requeued, result := failOnce(t, task, failures[i%len(failures)])
+		if requeued == nil {
+			t.Fatalf("requeue %d: the task failed (%+v), want it requeued", i+1, *result)
+		}
+		if requeued.Attempt != 1 || requeued.Requeues != i+1 {
+			t.Fatalf("got attempt %d after %d requeues, want attempt 1 after %d",
+				requeued.Attempt, requeued.Requeues, i+1)
+		}
+		task = *requeued
+	}
+
+	_, result := failOnce(t, task, failures[0])
+	if result == nil || !result.Failed || result.Failure != data.FailureInfrastructure || result.Attempt != 1 {
+		t.Fatalf("got %+v, want an infrastructure failure on attempt 1", result)
+	}
+}
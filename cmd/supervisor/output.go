@@ -0,0 +1,93 @@
+/**
+ * This file contains the supervisor's store of task output too long for a
+ * result.
+ *
+ * A worker puts the start of each of a task's streams in its result. When a
+ * stream is longer, the worker uploads all of it, up to the job's output
+ * limit, and it is kept in the state directory under the job's id and the id
+ * of the task's attempt. Clients fetch it, or the byte ranges of it they
+ * want, on demand.
+ **/
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strconv"
+
+	"github.com/showalter/bdws/internal/data"
+)
+
+const OUTPUT_DIR = "output"
+
+/* Room for the line a worker ends output that was cut off with */
+const OUTPUT_MARKER = 1 << 10
+
+// -- Global Variables --------------------------------------------------------
+var outputDir string /* Set once the state directory is open */
+
+// -- Internal Routines -------------------------------------------------------
+
+/** -- outputPath() -----------------------------------------------------------
+ *  Returns where a stream of a task's output is stored.
+ *
+ *  @param id      The id of the job
+ *  @param taskId  The id of the task's attempt, see taskId()
+ *  @param stream  data.StreamStdout or data.StreamStderr
+ ** ------------------------------------------------------------------------ */
+func outputPath(id int, taskId string, stream string) string {
+	return filepath.Join(outputDir, strconv.Itoa(id), taskId, stream)
+}
+
+/** -- outputHandler() --------------------------------------------------------
+ *  Handles the upload and download of task output too long for a result.
+ *
+ *  PUT /jobs/{id}/output/{task id}/{stream}  Store a stream of a task's
+ *                                            output
+ *  GET /jobs/{id}/output/{task id}/{stream}  Download it, or the part of it
+ *                                            named by a Range header
+ *
+ *  @param w      Write the reply into this writer
+ *  @param r      Information about the request
+ *  @param id     The id of the job
+ *  @param parts  The path of the request after /jobs/
+ ** ------------------------------------------------------------------------ */
+func outputHandler(w http.ResponseWriter, r *http.Request, id int, parts []string) {
+	if len(parts) != 4 || !validTaskId(id, parts[2]) || !data.ValidStream(parts[3]) {
+		replyError(w, http.StatusNotFound, "not found")
+		return
+	}
+	path := outputPath(id, parts[2], parts[3])
+
+	switch r.Method {
+	case http.MethodPut:
+		active, ok := lookupJob(id)
+		if !ok {
+			replyError(w, http.StatusNotFound, fmt.Sprintf("no job with id %d", id))
+			return
+		}
+
+		/* Workers keep no more than the job's limit */
+		limit := active.job.Limits.Output
+		if limit <= 0 {
+			limit = DEFAULT_MAX_OUTPUT
+		}
+		body, ok := uploadBody(w, r, limit+OUTPUT_MARKER)
+		if !ok {
+			return
+		}
+		if err := storeArtifact(path, body); err != nil {
+			fmt.Printf("[Supervisor] Could not store the %s of task %s: %v\n", parts[3], parts[2], err)
+			replyError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+	case http.MethodGet:
+		serveStored(w, r, path)
+
+	default:
+		replyError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
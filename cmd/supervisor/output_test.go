@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/showalter/bdws/internal/data"
+)
+
+func TestOutputRange(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bdws-supervisor-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	outputDir = dir
+
+	const id = 41
+	const limit = 200 << 10
+	jobsMutex.Lock()
+	jobs[id] = &ActiveJob{job: data.Job{Id: id, Limits: data.Limits{Output: limit}}}
+	jobsMutex.Unlock()
+	defer func() {
+		jobsMutex.Lock()
+		delete(jobs, id)
+		jobsMutex.Unlock()
+	}()
+
+	server := httptest.NewServer(http.HandlerFunc(jobsHandler))
+	defer server.Close()
+	url := fmt.Sprintf("%s/jobs/%d/output/%d.0.1/stdout", server.URL, id, id)
+
+	request := func(method string, body []byte, rangeHeader string) (int, []byte) {
+		req, err := http.NewRequest(method, url, bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rangeHeader != "" {
+			req.Header.Set("Range", rangeHeader)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		reply, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, reply
+	}
+
+	output := make([]byte, 100<<10)
+	for i := range output {
+		output[i] = byte('a' + i%26 + i/26%7)
+	}
+	if status, reply := request(http.MethodPut, output, ""); status != http.StatusOK {
+		t.Fatalf("upload: got %d: %s", status, reply)
+	}
+
+	tests := []struct {
+		name   string
+		header string
+		status int
+		want   []byte
+	}{
+		{"all of it", "", http.StatusOK, output},
+		{"past the inline output", "bytes=65536-65545", http.StatusPartialContent, output[65536:65546]},
+		{"from an offset", "bytes=100000-", http.StatusPartialContent, output[100000:]},
+		{"the end", "bytes=-10", http.StatusPartialContent, output[len(output)-10:]},
+		{"past the end", fmt.Sprintf("bytes=%d-", len(output)), http.StatusRequestedRangeNotSatisfiable, nil},
+	}
+	for _, test := range tests {
+		status, reply := request(http.MethodGet, nil, test.header)
+		if status != test.status {
+			t.Errorf("%s: got %d, want %d", test.name, status, test.status)
+		} else if test.want != nil && !bytes.Equal(reply, test.want) {
+			t.Errorf("%s: got %d bytes, want %d", test.name, len(reply), len(test.want))
+		}
+	}
+
+	// More than the job's limit and a marker is refused and the stored
+	// output is kept
+	if status, _ := request(http.MethodPut, make([]byte, limit+OUTPUT_MARKER+1), ""); status == http.StatusOK {
+		t.Errorf("an upload over the limit was stored")
+	}
+	if status, reply := request(http.MethodGet, nil, ""); status != http.StatusOK || !bytes.Equal(reply, output) {
+		t.Errorf("after a refused upload got %d with %d bytes, want the first upload", status, len(reply))
+	}
+}
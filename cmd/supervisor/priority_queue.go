@@ -9,8 +9,6 @@ package main
 
 import (
 	"container/heap"
-
-	"github.com/showalter/bdws/internal/data"
 )
 
 // -- Internal Structs --------------------------------------------------------
@@ -18,7 +16,7 @@ import (
 type Item struct {
 	index    int
 	priority int
-	job      data.Job
+	job      *ActiveJob
 }
 
 type PriorityQueue []*Item
@@ -32,13 +30,17 @@ func (pq PriorityQueue) Len() int { return len(pq) }
 
 /** -- compare() --------------------------------------------------------------
  *  Compares two Items within the priority queue and returns true if item i is
- *  greater than item j.
+ *  greater than item j. Items of equal priority are ordered by job id, so
+ *  they come out in the order they were submitted.
  *
  *  @param i Index of an item in the queue
  *  @param j Index of an item in the queue
  *  @return TRUE if i > j
  ** ------------------------------------------------------------------------ */
 func (pq PriorityQueue) Less(i, j int) bool {
+	if pq[i].priority == pq[j].priority {
+		return pq[i].job.job.Id < pq[j].job.job.Id
+	}
 	return pq[i].priority > pq[j].priority
 }
 
@@ -59,7 +61,7 @@ func (pq PriorityQueue) Swap(i, j int) {
  *
  *  @param x item to place into priority queue
  ** ------------------------------------------------------------------------ */
-func (pq *PriorityQueue) Push(x any) {
+func (pq *PriorityQueue) Push(x interface{}) {
 	n := len(*pq)
 	item := x.(*Item)
 	item.index = n
@@ -71,7 +73,7 @@ func (pq *PriorityQueue) Push(x any) {
  *
  *  @return Highest priority item in the queue
  ** ------------------------------------------------------------------------ */
-func (pq *PriorityQueue) Pop() any {
+func (pq *PriorityQueue) Pop() interface{} {
 	old := *pq
 	n := len(old)
 	item := old[n-1]
@@ -0,0 +1,264 @@
+/**
+ * This file contains the supervisor's task scheduler.
+ *
+ * Up to MAX_ACTIVE_JOBS jobs are active at once. Each active job keeps its
+ * own queue of pending tasks, and a SchedulingPolicy decides which job's task
+ * is handed to a free worker slot next. Only jobs whose requirements a free
+ * worker meets are considered, and when there are fewer pending tasks than
+ * free slots the fastest worker gets the task.
+ **/
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/showalter/bdws/internal/data"
+)
+
+const MAX_ACTIVE_JOBS = 16
+
+// -- Scheduling Policies -----------------------------------------------------
+
+/**
+ * Chooses which active job runs a task next.
+ **/
+type SchedulingPolicy interface {
+	/* Called with jobsMutex held. jobs holds every active job with a pending
+	 * task, in the order the jobs became active. */
+	pick(jobs []*ActiveJob) *ActiveJob
+}
+
+/**
+ * Runs the tasks of the job that became active first before any other.
+ **/
+type fifoPolicy struct{}
+
+func (fifoPolicy) pick(jobs []*ActiveJob) *ActiveJob {
+	return jobs[0]
+}
+
+/**
+ * Takes turns between active jobs, so a large sweep cannot starve a small
+ * job that arrives after it.
+ **/
+type fairPolicy struct {
+	turn uint64
+}
+
+func (p *fairPolicy) pick(jobs []*ActiveJob) *ActiveJob {
+	next := jobs[0]
+	for _, active := range jobs[1:] {
+		if active.served < next.served {
+			next = active
+		}
+	}
+
+	p.turn++
+	next.served = p.turn
+	return next
+}
+
+/**
+ * Runs the tasks of the highest priority job first, oldest job first among
+ * equals.
+ **/
+type priorityPolicy struct{}
+
+func (priorityPolicy) pick(jobs []*ActiveJob) *ActiveJob {
+	next := jobs[0]
+	for _, active := range jobs[1:] {
+		if active.job.Priority > next.job.Priority ||
+			(active.job.Priority == next.job.Priority && active.job.Id < next.job.Id) {
+			next = active
+		}
+	}
+	return next
+}
+
+/* Scheduling policies by the name given on the command line */
+var policies = map[string]SchedulingPolicy{
+	"fifo":     fifoPolicy{},
+	"fair":     &fairPolicy{},
+	"priority": priorityPolicy{},
+}
+
+/** -- policyNames() ----------------------------------------------------------
+ *  Returns the names of the scheduling policies.
+ ** ------------------------------------------------------------------------ */
+func policyNames() []string {
+	var names []string
+	for name := range policies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// -- Global Variables --------------------------------------------------------
+var policy SchedulingPolicy = &fairPolicy{}
+
+/* Jobs that have been split into tasks and are not finished, and worker
+ * slots waiting for a task, protected by jobsMutex */
+var activeJobs []*ActiveJob
+var idleSlots []ProtectedWorker
+var taskQueued = sync.NewCond(jobsMutex) /* Signalled when a task or a slot frees up */
+
+/* Holds a token for every active job */
+var activeSlots = make(chan struct{}, MAX_ACTIVE_JOBS)
+
+// -- Internal Routines -------------------------------------------------------
+
+/** -- activateJob() ----------------------------------------------------------
+ *  Makes a job's tasks available to the task manager. A job that was queued
+ *  is logged as started; a job resumed after a restart already was.
+ *
+ *  @param active   The job
+ *  @param nTasks   The number of tasks the job was split into
+ *  @param pending  The tasks of the job that have yet to finish
+ ** ------------------------------------------------------------------------ */
+func activateJob(active *ActiveJob, nTasks int, pending []Task) {
+	jobsMutex.Lock()
+	defer jobsMutex.Unlock()
+
+	/* The job was cancelled before it could start */
+	if active.status == data.JobCancelled {
+		<-activeSlots
+		return
+	}
+
+	if active.status == data.JobQueued {
+		logRecord(Record{Type: RecordStart, JobId: active.job.Id, NTasks: nTasks})
+		active.started = time.Now()
+	}
+
+	active.nTasks = nTasks
+	active.pending = pending
+	active.status = data.JobRunning
+	activeJobs = append(activeJobs, active)
+	taskQueued.Broadcast()
+}
+
+/** -- deactivateJob() --------------------------------------------------------
+ *  Removes a finished job from the active jobs. Called with jobsMutex held.
+ *
+ *  @param active  The job
+ ** ------------------------------------------------------------------------ */
+func deactivateJob(active *ActiveJob) {
+	for i, other := range activeJobs {
+		if other == active {
+			activeJobs = append(activeJobs[:i], activeJobs[i+1:]...)
+			break
+		}
+	}
+
+	jobsCompleted++
+	fmt.Printf("[Supervisor] Job %d is no longer active.\n", active.job.Id)
+	<-activeSlots
+}
+
+/** -- pushTask() -------------------------------------------------------------
+ *  Returns a task to its job's queue of pending tasks, unless the job was
+ *  cancelled.
+ *
+ *  @param task  The task
+ ** ------------------------------------------------------------------------ */
+func pushTask(task Task) {
+	jobsMutex.Lock()
+	defer jobsMutex.Unlock()
+
+	if task.job.status == data.JobCancelled {
+		return
+	}
+
+	task.job.pending = append(task.job.pending, task)
+	taskQueued.Broadcast()
+}
+
+/** -- releaseSlot() ----------------------------------------------------------
+ *  Makes a worker slot available for another task.
+ *
+ *  @param pWorker  The slot
+ ** ------------------------------------------------------------------------ */
+func releaseSlot(pWorker ProtectedWorker) {
+	jobsMutex.Lock()
+	defer jobsMutex.Unlock()
+
+	idleSlots = append(idleSlots, pWorker)
+	taskQueued.Broadcast()
+}
+
+/** -- chooseSlot() -----------------------------------------------------------
+ *  Finds a free slot that can run the tasks of a job. Called with jobsMutex
+ *  held.
+ *
+ *  @param active      The job
+ *  @param preferFast  Whether to pick the fastest worker instead of the slot
+ *                     that has been free the longest
+ *  @return The index of the slot in idleSlots, or -1 if none fits
+ ** ------------------------------------------------------------------------ */
+func chooseSlot(active *ActiveJob, preferFast bool) int {
+	chosen := -1
+	for i, slot := range idleSlots {
+		if !satisfies(active, slot) {
+			continue
+		}
+		if !preferFast {
+			return i
+		}
+		if chosen < 0 || slot.reg.CpuSpeed > idleSlots[chosen].reg.CpuSpeed {
+			chosen = i
+		}
+	}
+	return chosen
+}
+
+/** -- nextAssignment() -------------------------------------------------------
+ *  Waits until a pending task can be paired with a free worker slot that meets
+ *  its job's requirements. The scheduling policy picks among the jobs that
+ *  have such a slot.
+ *
+ *  @return The task to dispatch and the slot to dispatch it to
+ ** ------------------------------------------------------------------------ */
+func nextAssignment() (Task, ProtectedWorker) {
+	jobsMutex.Lock()
+	defer jobsMutex.Unlock()
+
+	for {
+		/* Forget the slots of evicted workers */
+		live := idleSlots[:0]
+		for _, slot := range idleSlots {
+			if alive(slot) {
+				live = append(live, slot)
+			}
+		}
+		idleSlots = live
+
+		pending := 0
+		var ready []*ActiveJob
+		for _, active := range activeJobs {
+			pending += len(active.pending)
+			if len(active.pending) > 0 && chooseSlot(active, false) >= 0 {
+				ready = append(ready, active)
+			}
+		}
+
+		if len(ready) > 0 {
+			active := policy.pick(ready)
+			task := active.pending[0]
+			active.pending = active.pending[1:]
+
+			/* With a short queue every task can go to a fast worker */
+			i := chooseSlot(active, pending <= len(idleSlots))
+			slot := idleSlots[i]
+			idleSlots = append(idleSlots[:i], idleSlots[i+1:]...)
+
+			return task, slot
+		}
+
+		taskQueued.Wait()
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/showalter/bdws/internal/data"
+)
+
+// An active job with n pending tasks.
+func activeJob(id int, priority int, n int) *ActiveJob {
+	active := &ActiveJob{job: data.Job{Id: id, Priority: priority}, status: data.JobRunning}
+	for i := 0; i < n; i++ {
+		active.pending = append(active.pending, Task{JobId: id, Index: i, job: active})
+	}
+	return active
+}
+
+// Register workers and return a slot on each.
+func workerSlots(regs ...data.Registration) ([]ProtectedWorker, func()) {
+	var slots []ProtectedWorker
+	for _, reg := range regs {
+		slots = append(slots, addWorker(reg))
+	}
+	return slots, func() {
+		for _, slot := range slots {
+			evictWorker(slot.worker.Id, "test over")
+		}
+	}
+}
+
+// Hand out every pending task of some jobs under a policy, giving the slot
+// back each time, and return the ids of the jobs in the order their tasks
+// were handed out along with the hosts they went to.
+func schedule(p SchedulingPolicy, active []*ActiveJob, slots []ProtectedWorker) ([]int, []string) {
+	jobsMutex.Lock()
+	saved := policy
+	policy = p
+	activeJobs = active
+	idleSlots = append([]ProtectedWorker(nil), slots...)
+	pending := 0
+	for _, a := range active {
+		pending += len(a.pending)
+	}
+	jobsMutex.Unlock()
+
+	var order []int
+	var hosts []string
+	for i := 0; i < pending; i++ {
+		task, slot := nextAssignment()
+		order = append(order, task.JobId)
+		hosts = append(hosts, slot.worker.Hostname)
+		releaseSlot(slot)
+	}
+
+	jobsMutex.Lock()
+	policy = saved
+	activeJobs = nil
+	idleSlots = nil
+	jobsMutex.Unlock()
+	return order, hosts
+}
+
+func TestSchedulingPolicies(t *testing.T) {
+	slots, cleanup := workerSlots(data.Registration{Hostname: "alpha:5802", Cores: 1})
+	defer cleanup()
+
+	tests := []struct {
+		name   string
+		policy SchedulingPolicy
+		jobs   []*ActiveJob
+		want   []int
+	}{
+		{"fifo runs the first job out", fifoPolicy{}, []*ActiveJob{
+			activeJob(1, 0, 3), activeJob(2, 0, 2),
+		}, []int{1, 1, 1, 2, 2}},
+		{"fifo ignores priority", fifoPolicy{}, []*ActiveJob{
+			activeJob(1, 0, 1), activeJob(2, 9, 1),
+		}, []int{1, 2}},
+		{"fair takes turns", &fairPolicy{}, []*ActiveJob{
+			activeJob(1, 0, 3), activeJob(2, 0, 1), activeJob(3, 0, 2),
+		}, []int{1, 2, 3, 1, 3, 1}},
+		{"priority runs the highest first", priorityPolicy{}, []*ActiveJob{
+			activeJob(1, 0, 2), activeJob(2, 5, 1), activeJob(3, 9, 2),
+		}, []int{3, 3, 2, 1, 1}},
+		{"priority breaks ties by id", priorityPolicy{}, []*ActiveJob{
+			activeJob(4, 5, 1), activeJob(2, 5, 2), activeJob(3, 0, 1),
+		}, []int{2, 2, 4, 3}},
+	}
+
+	for _, test := range tests {
+		if got, _ := schedule(test.policy, test.jobs, slots); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestReprioritize(t *testing.T) {
+	jobsMutex.Lock()
+	saved := jobQueue
+	jobQueue = &PriorityQueue{}
+	jobsMutex.Unlock()
+	defer func() {
+		jobsMutex.Lock()
+		jobQueue = saved
+		jobsMutex.Unlock()
+	}()
+
+	queued := []*ActiveJob{activeJob(1, 0, 0), activeJob(2, 0, 0), activeJob(3, 0, 0), activeJob(4, 0, 0)}
+	for _, active := range queued {
+		active.status = data.JobQueued
+		enqueueJob(active)
+	}
+
+	// Raising a job moves it ahead, and jobs of equal priority go in id
+	// order whichever was raised first
+	prioritize := func(active *ActiveJob, priority string) int {
+		w := httptest.NewRecorder()
+		setPriority(w, httptest.NewRequest(http.MethodPut, "/jobs/1/priority", strings.NewReader(priority)), active)
+		return w.Code
+	}
+	prioritize(queued[3], "5")
+	prioritize(queued[2], "5")
+	prioritize(queued[0], "-1")
+
+	var order []int
+	for range queued {
+		order = append(order, nextJob().job.Id)
+	}
+	if want := []int{3, 4, 2, 1}; !reflect.DeepEqual(order, want) {
+		t.Errorf("got %v, want %v", order, want)
+	}
+
+	if status := prioritize(queued[0], "9"); status != http.StatusConflict {
+		t.Errorf("reprioritizing a job that left the queue: got %d, want %d", status, http.StatusConflict)
+	}
+}
+
+func TestChooseSlot(t *testing.T) {
+	slots, cleanup := workerSlots(
+		data.Registration{Hostname: "small:5802", Cores: 2, MemAvailable: 1000, ModelName: "ARM Cortex-A72", CpuSpeed: 1.5},
+		data.Registration{Hostname: "fast:5802", Cores: 8, MemAvailable: 4000, ModelName: "AMD EPYC 7543", CpuSpeed: 3.7},
+		data.Registration{Hostname: "big:5802", Cores: 16, MemAvailable: 64000, ModelName: "Intel Xeon Gold", CpuSpeed: 2.4},
+	)
+	defer cleanup()
+
+	tests := []struct {
+		name       string
+		requires   data.Requirements
+		preferFast bool
+		want       string // "" if no slot fits
+	}{
+		{"anything", data.Requirements{}, false, "small:5802"},
+		{"anything, fastest", data.Requirements{}, true, "fast:5802"},
+		{"cores", data.Requirements{MinCores: 4}, false, "fast:5802"},
+		{"cores, fastest", data.Requirements{MinCores: 10}, true, "big:5802"},
+		{"memory", data.Requirements{MinMemory: 5000}, false, "big:5802"},
+		{"model", data.Requirements{CpuModel: "(?i)xeon|arm"}, false, "small:5802"},
+		{"model, fastest", data.Requirements{CpuModel: "(?i)xeon|arm"}, true, "big:5802"},
+		{"everything", data.Requirements{MinCores: 8, MinMemory: 4000, CpuModel: "EPYC"}, true, "fast:5802"},
+		{"nothing fits", data.Requirements{MinCores: 32}, false, ""},
+	}
+
+	jobsMutex.Lock()
+	idleSlots = slots
+	jobsMutex.Unlock()
+	defer func() {
+		jobsMutex.Lock()
+		idleSlots = nil
+		jobsMutex.Unlock()
+	}()
+
+	for _, test := range tests {
+		job := data.Job{Requires: test.requires}
+		pattern, err := checkJob(job)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+
+		jobsMutex.Lock()
+		i := chooseSlot(&ActiveJob{job: job, modelPattern: pattern}, test.preferFast)
+		got := ""
+		if i >= 0 {
+			got = idleSlots[i].worker.Hostname
+		}
+		jobsMutex.Unlock()
+
+		if got != test.want {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestShortQueuePrefersFastWorkers(t *testing.T) {
+	slots, cleanup := workerSlots(
+		data.Registration{Hostname: "slow:5802", Cores: 1, CpuSpeed: 1.2},
+		data.Registration{Hostname: "fast:5802", Cores: 1, CpuSpeed: 3.6},
+	)
+	defer cleanup()
+
+	// Fewer tasks than free slots all go to the fastest worker; more go to
+	// the slot that has been free the longest
+	tests := []struct {
+		name  string
+		tasks int
+		want  []string
+	}{
+		{"short queue", 2, []string{"fast:5802", "fast:5802"}},
+		{"long queue", 3, []string{"slow:5802", "fast:5802", "fast:5802"}},
+	}
+
+	for _, test := range tests {
+		_, hosts := schedule(fifoPolicy{}, []*ActiveJob{activeJob(1, 0, test.tasks)}, slots)
+		if !reflect.DeepEqual(hosts, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, hosts, test.want)
+		}
+	}
+}
@@ -0,0 +1,552 @@
+/**
+ * This file contains the supervisor's write-ahead log.
+ *
+ * Every change to a job (submission, start, dispatch attempts, results,
+ * priority changes and cancellation) is appended to a log in the state
+ * directory and synced to disk before it takes effect. When the supervisor
+ * starts it replays the log: finished jobs keep their results, running jobs
+ * resume with only the tasks that had not completed, and queued jobs go back
+ * into the job queue. Workers re-register on their own once their heartbeats
+ * are rejected.
+ *
+ * Finished jobs live on in the history, so their records are only kept until
+ * the log is compacted: it is rewritten with the records of unfinished jobs
+ * when the supervisor starts, and whenever the records of finished jobs make
+ * up most of it. Compacting does not hold up appends; the records appended
+ * while it runs are carried over to the new log before it replaces the old.
+ **/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/showalter/bdws/internal/data"
+)
+
+const WAL_FILE = "wal.log"
+const COMPACT_MIN = 1 << 20 /* Bytes of finished jobs' records worth compacting the log for */
+
+// Kinds of log records
+const (
+	RecordJob      = "job"      /* A job was submitted */
+	RecordStart    = "start"    /* A job was split into tasks */
+	RecordAttempt  = "attempt"  /* A task was dispatched */
+	RecordResult   = "result"   /* A task finished */
+	RecordPriority = "priority" /* A queued job was re-prioritized */
+	RecordCancel   = "cancel"   /* A job was cancelled */
+)
+
+// -- Internal Structs --------------------------------------------------------
+
+/**
+ * One entry in the write-ahead log.
+ **/
+type Record struct {
+	Type     string
+	JobId    int
+	Time     time.Time
+	Job      *data.Job        `json:",omitempty"`
+	NTasks   int              `json:",omitempty"`
+	Index    int              `json:",omitempty"`
+	Attempt  int              `json:",omitempty"`
+	Worker   string           `json:",omitempty"`
+	Result   *data.TaskResult `json:",omitempty"`
+	Priority int              `json:",omitempty"`
+}
+
+// -- Global Variables --------------------------------------------------------
+var wal *os.File
+var walPath string
+var walMutex = &sync.Mutex{}
+var walLive = make(map[int]int64) /* Bytes in the log for each unfinished job */
+var walDead int64                 /* Bytes in the log for finished jobs */
+var walCompacting bool            /* Whether the log is being compacted */
+
+// -- Internal Routines -------------------------------------------------------
+
+/** -- logRecord() ------------------------------------------------------------
+ *  Appends a record to the write-ahead log and syncs it to disk.
+ *
+ *  @param record  The record to append
+ ** ------------------------------------------------------------------------ */
+func logRecord(record Record) {
+	walMutex.Lock()
+	defer walMutex.Unlock()
+
+	if wal == nil {
+		return
+	}
+
+	record.Time = time.Now()
+	b, err := json.Marshal(record)
+	if err != nil {
+		panic(err)
+	}
+
+	n, err := wal.Write(append(b, '\n'))
+	if err != nil {
+		fmt.Printf("[Supervisor] Could not write to the log: %v\n", err)
+		return
+	}
+	wal.Sync()
+
+	/* A cancelled job's tasks still report back, but only the history needs them */
+	if _, ok := walLive[record.JobId]; ok || record.Type == RecordJob {
+		walLive[record.JobId] += int64(n)
+	} else {
+		walDead += int64(n)
+	}
+}
+
+/** -- finishLog() ------------------------------------------------------------
+ *  Marks the records of a job that has been archived as no longer needed,
+ *  and compacts the log once they make up most of it.
+ *
+ *  @param id  The id of the job
+ ** ------------------------------------------------------------------------ */
+func finishLog(id int) {
+	walMutex.Lock()
+	size, ok := walLive[id]
+	if !ok {
+		walMutex.Unlock()
+		return
+	}
+	delete(walLive, id)
+	walDead += size
+
+	var live int64
+	for _, size := range walLive {
+		live += size
+	}
+	if wal == nil || walCompacting || walDead < COMPACT_MIN || walDead < live {
+		walMutex.Unlock()
+		return
+	}
+
+	/* Take note of where the log ends and which jobs it is kept for, then
+	 * let appends go on while it is compacted */
+	end, err := wal.Seek(0, io.SeekEnd)
+	keep := make(map[int]bool)
+	for id := range walLive {
+		keep[id] = true
+	}
+	walCompacting = err == nil
+	walMutex.Unlock()
+
+	if err == nil {
+		err = compactLog(end, keep)
+	}
+	if err != nil {
+		fmt.Printf("[Supervisor] Could not compact the log: %v\n", err)
+	}
+}
+
+/** -- compactLog() -----------------------------------------------------------
+ *  Rewrites the log with the records of the jobs it is kept for, then with
+ *  everything appended to it since.
+ *
+ *  @param end   Where the log ended when compacting started
+ *  @param keep  The jobs whose records up to there are kept
+ ** ------------------------------------------------------------------------ */
+func compactLog(end int64, keep map[int]bool) error {
+	defer func() {
+		walMutex.Lock()
+		walCompacting = false
+		walMutex.Unlock()
+	}()
+
+	file, err := os.Open(walPath)
+	if err != nil {
+		return err
+	}
+	records, err := scanRecords(io.LimitReader(file, end))
+	file.Close()
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.OpenFile(walPath+".tmp", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	sizes, err := writeRecords(tmp, records, keep)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+
+	/* Nothing is appended from here on until the new log is in place */
+	walMutex.Lock()
+	defer walMutex.Unlock()
+
+	tail, err := readTail(end)
+	if err == nil {
+		_, err = tmp.Write(tail)
+	}
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	for _, line := range bytes.SplitAfter(tail, []byte("\n")) {
+		var record Record
+		if json.Unmarshal(line, &record) == nil {
+			sizes[record.JobId] += int64(len(line))
+		}
+	}
+	return replaceLog(tmp, sizes)
+}
+
+/** -- readTail() -------------------------------------------------------------
+ *  Reads what was appended to the log past a point. Called with walMutex
+ *  held.
+ *
+ *  @param end  Where to read from
+ ** ------------------------------------------------------------------------ */
+func readTail(end int64) ([]byte, error) {
+	file, err := os.Open(walPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	if _, err := file.Seek(end, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(file)
+}
+
+/** -- rewriteLog() -----------------------------------------------------------
+ *  Replaces the log with the records of the unfinished jobs. Called with
+ *  walMutex held.
+ *
+ *  @param records  Every record of the log
+ ** ------------------------------------------------------------------------ */
+func rewriteLog(records []Record) error {
+	tmp, err := os.OpenFile(walPath+".tmp", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	keep := make(map[int]bool)
+	for id := range walLive {
+		keep[id] = true
+	}
+	sizes, err := writeRecords(tmp, records, keep)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	return replaceLog(tmp, sizes)
+}
+
+/** -- writeRecords() ---------------------------------------------------------
+ *  Writes the records of some jobs to a new log.
+ *
+ *  @param file     The new log
+ *  @param records  The records to pick from
+ *  @param keep     The jobs whose records are written
+ *  @return The bytes written for each job
+ ** ------------------------------------------------------------------------ */
+func writeRecords(file *os.File, records []Record, keep map[int]bool) (map[int]int64, error) {
+	sizes := make(map[int]int64)
+	writer := bufio.NewWriter(file)
+	for _, record := range records {
+		if !keep[record.JobId] {
+			continue
+		}
+		b, err := json.Marshal(record)
+		if err != nil {
+			return nil, err
+		}
+		writer.Write(append(b, '\n'))
+		sizes[record.JobId] += int64(len(b) + 1)
+	}
+	return sizes, writer.Flush()
+}
+
+/** -- replaceLog() -----------------------------------------------------------
+ *  Puts a new log in place of the old one and keeps appending to it. The
+ *  new log is written next to the old one and renamed over it, so a crash
+ *  leaves one or the other. Called with walMutex held.
+ *
+ *  @param tmp    The new log, which is closed
+ *  @param sizes  The bytes in the new log for each job
+ ** ------------------------------------------------------------------------ */
+func replaceLog(tmp *os.File, sizes map[int]int64) error {
+	err := tmp.Sync()
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), walPath); err != nil {
+		return err
+	}
+
+	/* Keep appending to the new log */
+	if wal != nil {
+		wal.Close()
+	}
+	wal, err = os.OpenFile(walPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	walDead = 0
+	for id, size := range sizes {
+		if _, ok := walLive[id]; !ok {
+			walDead += size
+		}
+	}
+	for id := range walLive {
+		walLive[id] = sizes[id]
+	}
+	return err
+}
+
+/** -- readRecords() ----------------------------------------------------------
+ *  Reads every record in a write-ahead log. A torn record at the end of the
+ *  log, left by a crash in the middle of a write, is ignored.
+ *
+ *  @param path  The log file
+ *  @return The records in the order they were written
+ ** ------------------------------------------------------------------------ */
+func readRecords(path string) ([]Record, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return scanRecords(file)
+}
+
+/** -- scanRecords() ----------------------------------------------------------
+ *  Reads the records of a log, skipping damaged ones.
+ *
+ *  @param r  The log
+ *  @return The records in the order they were written
+ ** ------------------------------------------------------------------------ */
+func scanRecords(r io.Reader) ([]Record, error) {
+	var records []Record
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1<<31-1)
+	for scanner.Scan() {
+		var record Record
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			fmt.Printf("[Supervisor] Skipping damaged log record: %v\n", err)
+			continue
+		}
+		records = append(records, record)
+	}
+
+	return records, scanner.Err()
+}
+
+/** -- openStore() ------------------------------------------------------------
+ *  Recovers the supervisor's jobs from the write-ahead log in a directory,
+ *  then rewrites the log with only the unfinished jobs and opens it for
+ *  appending.
+ *
+ *  @param dir  The state directory
+ ** ------------------------------------------------------------------------ */
+func openStore(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	historyDir = filepath.Join(dir, HISTORY_DIR)
+	if err := os.MkdirAll(historyDir, 0755); err != nil {
+		return err
+	}
+
+	artifactsDir = filepath.Join(dir, ARTIFACTS_DIR)
+	if err := os.MkdirAll(artifactsDir, 0755); err != nil {
+		return err
+	}
+
+	outputDir = filepath.Join(dir, OUTPUT_DIR)
+	if err := os.MkdirAll(outputDir, 0755); err != nil {
+		return err
+	}
+
+	logsDir = filepath.Join(dir, LOGS_DIR)
+	if err := os.MkdirAll(logsDir, 0755); err != nil {
+		return err
+	}
+
+	walPath = filepath.Join(dir, WAL_FILE)
+	records, err := readRecords(walPath)
+	if err != nil {
+		return err
+	}
+	recoverJobs(records)
+
+	/* Never reuse the id of an archived job, even if the log was deleted */
+	if ids := archivedIds(); len(ids) > 0 && ids[len(ids)-1] >= nextJobId {
+		nextJobId = ids[len(ids)-1] + 1
+	}
+
+	/* Start again from a log of only the unfinished jobs */
+	jobsMutex.Lock()
+	walMutex.Lock()
+	defer walMutex.Unlock()
+	for id, active := range jobs {
+		if active.status == data.JobQueued || active.status == data.JobRunning {
+			walLive[id] = 0
+		}
+	}
+	jobsMutex.Unlock()
+
+	return rewriteLog(records)
+}
+
+/** -- recoverJobs() ----------------------------------------------------------
+ *  Rebuilds the job table from log records and puts unfinished jobs back to
+ *  work.
+ *
+ *  @param records  The records of the write-ahead log
+ ** ------------------------------------------------------------------------ */
+func recoverJobs(records []Record) {
+	attempts := make(map[int]map[int]int) /* Last attempt of each task, by job */
+	completed := make(map[int]map[int]bool)
+
+	jobsMutex.Lock()
+	for _, record := range records {
+		if record.Type == RecordJob {
+			if record.Job == nil {
+				continue
+			}
+			record.Job.Id = record.JobId
+			if len(record.Job.Code) > 0 && record.Job.CodeHash == "" {
+				record.Job.CodeHash = data.HashCode(record.Job.Code)
+			}
+			active := &ActiveJob{
+				job:       *record.Job,
+				status:    data.JobQueued,
+				submitted: record.Time,
+				done:      make(chan struct{}),
+				inFlight:  make(map[int]dispatched),
+			}
+
+			/* Logs written before a check was added may hold jobs that
+			 * cannot run; they are failed rather than started */
+			pattern, err := checkJob(*record.Job)
+			if err != nil {
+				fmt.Printf("[Supervisor] Failing job %d from the log: %v\n", record.JobId, err)
+				active.status = data.JobFailed
+				active.finished = record.Time
+			}
+			active.modelPattern = pattern
+			jobs[record.JobId] = active
+			attempts[record.JobId] = make(map[int]int)
+			completed[record.JobId] = make(map[int]bool)
+			if record.JobId >= nextJobId {
+				nextJobId = record.JobId + 1
+			}
+			continue
+		}
+
+		active, ok := jobs[record.JobId]
+		if !ok {
+			continue
+		}
+
+		switch record.Type {
+		case RecordStart:
+			if active.status == data.JobQueued {
+				active.status = data.JobRunning
+				active.nTasks = record.NTasks
+				active.started = record.Time
+			}
+		case RecordAttempt:
+			attempts[record.JobId][record.Index] = record.Attempt
+		case RecordResult:
+			active.results = append(active.results, *record.Result)
+			if record.Result.Failed {
+				active.failed++
+			}
+			completed[record.JobId][record.Index] = true
+			active.finished = record.Time
+		case RecordPriority:
+			active.job.Priority = record.Priority
+		case RecordCancel:
+			active.status = data.JobCancelled
+			active.finished = record.Time
+		}
+	}
+
+	var ids []int
+	for id := range jobs {
+		ids = append(ids, id)
+	}
+	jobsMutex.Unlock()
+	sort.Ints(ids)
+
+	/* Put the unfinished jobs back to work in the order they were submitted */
+	for _, id := range ids {
+		active := jobs[id]
+
+		switch {
+		case active.status == data.JobCancelled || active.status == data.JobFailed:
+			close(active.done)
+			if !archived(id) {
+				jobsMutex.Lock()
+				archiveJob(active, false)
+				jobsMutex.Unlock()
+			}
+			delete(jobs, id)
+
+		case active.status == data.JobQueued:
+			enqueueJob(active)
+
+		case len(active.results) >= active.nTasks:
+			active.status = data.JobDone
+			if active.failed > 0 {
+				active.status = data.JobFailed
+			}
+			close(active.done)
+			if !archived(id) {
+				jobsMutex.Lock()
+				archiveJob(active, false)
+				jobsMutex.Unlock()
+			}
+			delete(jobs, id)
+
+		default:
+			runs := active.job.Nruns
+			if runs < 1 {
+				runs = 1
+			}
+
+			var pending []Task
+			for _, task := range splitJob(active, active.nTasks/runs) {
+				if completed[id][task.Index] {
+					continue
+				}
+				/* The interrupted attempt was lost with the supervisor, so it is run again */
+				if attempt, ok := attempts[id][task.Index]; ok {
+					task.Attempt = attempt
+				}
+				pending = append(pending, task)
+			}
+
+			fmt.Printf("[Supervisor] Resuming job %d with %d of %d tasks left.\n",
+				id, len(pending), active.nTasks)
+			activeSlots <- struct{}{}
+			activateJob(active, active.nTasks, pending)
+		}
+	}
+}
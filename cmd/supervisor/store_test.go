@@ -0,0 +1,203 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/showalter/bdws/internal/data"
+)
+
+// Start from an empty supervisor with its state in a temporary directory.
+func emptyStore(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "bdws-store-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	forget()
+	return dir, func() {
+		forget()
+		os.RemoveAll(dir)
+	}
+}
+
+// Lose everything the supervisor holds in memory, as a crash would.
+func forget() {
+	walMutex.Lock()
+	if wal != nil {
+		wal.Close()
+	}
+	wal = nil
+	walLive = make(map[int]int64)
+	walDead = 0
+	walMutex.Unlock()
+
+	jobsMutex.Lock()
+	jobs = make(map[int]*ActiveJob)
+	nextJobId = 1
+	jobQueue = &PriorityQueue{}
+	activeJobs = nil
+	jobsMutex.Unlock()
+	for len(activeSlots) > 0 {
+		<-activeSlots
+	}
+}
+
+// Submit a job with a task for every parameter in 1..n, started if asked.
+func submit(n int, start bool) (*ActiveJob, []Task) {
+	active := addJob(data.Job{FileName: "sweep.sh", Code: []byte("echo $1"),
+		ParameterStart: 1, ParameterEnd: n, Nruns: 1}, nil)
+	if !start {
+		enqueueJob(active)
+		return active, nil
+	}
+	tasks := splitJob(active, 1)
+	activeSlots <- struct{}{}
+	activateJob(active, len(tasks), tasks)
+	return active, tasks
+}
+
+// Dispatch a task and have it finish with the given stdout.
+func finish(task Task, stdout string) {
+	pWorker := ProtectedWorker{worker: data.Worker{Id: -1, Hostname: "worker:1"}}
+	taskStarted(task, pWorker)
+	taskFinished(task, data.TaskResult{Parameter: task.Parameter, Attempt: task.Attempt, Stdout: stdout})
+}
+
+// Recover the supervisor from its state directory after a crash.
+func restart(t *testing.T, dir string) {
+	forget()
+	if err := openStore(dir); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRecoverAfterCrash(t *testing.T) {
+	dir, cleanup := emptyStore(t)
+	defer cleanup()
+	if err := openStore(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	running, tasks := submit(3, true)
+	finish(tasks[0], "1")
+	tasks[1].Attempt = 2
+	taskStarted(tasks[1], ProtectedWorker{worker: data.Worker{Id: -1, Hostname: "worker:1"}})
+	done, doneTasks := submit(1, true)
+	finish(doneTasks[0], "done")
+	queued, _ := submit(2, false)
+	cancelled, _ := submit(2, false)
+	cancelJob(cancelled)
+
+	restart(t, dir)
+
+	active, ok := jobs[running.job.Id]
+	if !ok || active.status != data.JobRunning || active.nTasks != 3 || len(active.results) != 1 {
+		t.Fatalf("running job: got %+v, want it running with 1 of 3 results", active)
+	}
+	if len(active.pending) != 2 {
+		t.Fatalf("running job: got %d tasks pending, want the 2 unfinished ones", len(active.pending))
+	}
+	for _, task := range active.pending {
+		if task.Index == tasks[1].Index && task.Attempt != 2 {
+			t.Errorf("the interrupted task is on attempt %d, want 2", task.Attempt)
+		}
+	}
+
+	if active, ok := jobs[queued.job.Id]; !ok || active.status != data.JobQueued || active.item == nil {
+		t.Errorf("queued job: got %+v, want it back in the job queue", active)
+	}
+	for _, finished := range []*ActiveJob{done, cancelled} {
+		if _, ok := jobs[finished.job.Id]; ok || !archived(finished.job.Id) {
+			t.Errorf("job %d is in memory or not in the history, want it only archived", finished.job.Id)
+		}
+	}
+	if nextJobId != cancelled.job.Id+1 {
+		t.Errorf("next job id is %d, want %d", nextJobId, cancelled.job.Id+1)
+	}
+
+	// The log only holds the unfinished jobs now, and they survive another
+	// restart
+	restart(t, dir)
+	if len(jobs) != 2 || jobs[running.job.Id] == nil || jobs[queued.job.Id] == nil {
+		t.Errorf("got %d jobs after a second restart, want the running and the queued one", len(jobs))
+	}
+}
+
+func TestRecoverTornRecord(t *testing.T) {
+	dir, cleanup := emptyStore(t)
+	defer cleanup()
+	if err := openStore(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	running, tasks := submit(2, true)
+	finish(tasks[0], "1")
+
+	// A crash in the middle of writing the second task's result
+	walMutex.Lock()
+	wal.Write([]byte(`{"Type":"result","JobId":1,"Index":1,"Result":{"Stdout":"2`))
+	walMutex.Unlock()
+
+	restart(t, dir)
+	active, ok := jobs[running.job.Id]
+	if !ok || len(active.results) != 1 || len(active.pending) != 1 {
+		t.Fatalf("got %+v, want the job with 1 result and 1 task pending", active)
+	}
+
+	// The torn record is gone once the log is rewritten, so records
+	// appended after it are read
+	finish(active.pending[0], "2")
+	restart(t, dir)
+	if _, ok := jobs[running.job.Id]; ok || !archived(running.job.Id) {
+		t.Errorf("the job did not finish after the torn record")
+	}
+}
+
+func TestRecoverAfterCompaction(t *testing.T) {
+	dir, cleanup := emptyStore(t)
+	defer cleanup()
+	if err := openStore(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	live, liveTasks := submit(3, true)
+	finish(liveTasks[0], "first")
+
+	// Finish jobs until their records are worth compacting the log for
+	big := strings.Repeat("x", COMPACT_MIN/4)
+	var finished []*ActiveJob
+	for i := 0; i < 5; i++ {
+		active, tasks := submit(1, true)
+		finish(tasks[0], big)
+		finished = append(finished, active)
+	}
+	finish(liveTasks[1], "second")
+
+	info, err := os.Stat(filepath.Join(dir, WAL_FILE))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() >= COMPACT_MIN {
+		t.Fatalf("the log is %d bytes, want it compacted", info.Size())
+	}
+	walMutex.Lock()
+	if walLive[live.job.Id] == 0 || walDead >= COMPACT_MIN {
+		t.Errorf("got %d bytes live and %d dead, want the live job's records counted", walLive[live.job.Id], walDead)
+	}
+	walMutex.Unlock()
+
+	restart(t, dir)
+	active, ok := jobs[live.job.Id]
+	if !ok || len(active.results) != 2 || len(active.pending) != 1 {
+		t.Fatalf("got %+v, want the live job with 2 results and 1 task pending", active)
+	}
+	for _, job := range finished {
+		archive, ok := loadArchive(job.job.Id)
+		if _, inMemory := jobs[job.job.Id]; inMemory || !ok || len(archive.Results) != 1 || archive.Results[0].Stdout != big {
+			t.Errorf("job %d is not in the history with its result", job.job.Id)
+		}
+	}
+}
@@ -0,0 +1,246 @@
+/**
+ * This file contains the supervisor's registry of workers.
+ *
+ * Workers send a heartbeat every data.HeartbeatInterval. A worker that misses
+ * MISSED_HEARTBEATS in a row is evicted: its in-flight requests are cancelled
+ * so their tasks go back into the task queue, and it is never handed another
+ * task. An evicted worker that is still running re-registers when its next
+ * heartbeat is rejected.
+ **/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/showalter/bdws/internal/data"
+)
+
+const MISSED_HEARTBEATS = 3
+
+// -- Internal Structs --------------------------------------------------------
+
+/**
+ * What the supervisor knows about a registered worker.
+ **/
+type WorkerState struct {
+	pWorker       ProtectedWorker
+	reg           data.Registration
+	cancel        context.CancelFunc
+	lastHeartbeat time.Time
+	load          float64
+	memAvailable  int
+}
+
+// -- Global Variables --------------------------------------------------------
+var workerTable = make(map[int64]*WorkerState)
+var workerMutex = &sync.Mutex{}
+var nextWorkerId int64 = 1
+
+// -- Internal Routines -------------------------------------------------------
+
+/** -- addWorker() ------------------------------------------------------------
+ *  Assigns a newly registered worker an id and starts tracking it.
+ *
+ *  @param reg  The registration sent by the worker
+ *  @return The worker, ready to be placed in the pool
+ ** ------------------------------------------------------------------------ */
+func addWorker(reg data.Registration) ProtectedWorker {
+	workerMutex.Lock()
+	defer workerMutex.Unlock()
+
+	worker := data.Worker{Id: nextWorkerId, Busy: false, Hostname: reg.Hostname}
+	nextWorkerId++
+
+	ctx, cancel := context.WithCancel(context.Background())
+	pWorker := ProtectedWorker{worker, reg, ctx}
+
+	workerTable[worker.Id] = &WorkerState{
+		pWorker:       pWorker,
+		reg:           reg,
+		cancel:        cancel,
+		lastHeartbeat: time.Now(),
+		memAvailable:  reg.MemAvailable,
+	}
+
+	return pWorker
+}
+
+/** -- checkHostname() --------------------------------------------------------
+ *  Checks that a worker registered with an address the supervisor can send
+ *  requests to.
+ *
+ *  @param hostname  The host:port from the worker's registration
+ *  @return Why the address cannot be used, or nil
+ ** ------------------------------------------------------------------------ */
+func checkHostname(hostname string) error {
+	host, port, err := net.SplitHostPort(hostname)
+	if err != nil {
+		return err
+	}
+	if host == "" {
+		return fmt.Errorf("no host in %q", hostname)
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		return fmt.Errorf("invalid port in %q", hostname)
+	}
+
+	/* Reject anything that would not survive being put into a URL */
+	u, err := url.Parse("http://" + hostname + "/")
+	if err != nil {
+		return err
+	}
+	if u.Host != hostname {
+		return fmt.Errorf("%q is not a plain host:port", hostname)
+	}
+	return nil
+}
+
+/** -- evictWorker() ----------------------------------------------------------
+ *  Forgets a worker and cancels every request in flight to it.
+ *
+ *  @param id      The id of the worker
+ *  @param reason  Why the worker is being evicted
+ ** ------------------------------------------------------------------------ */
+func evictWorker(id int64, reason string) {
+	workerMutex.Lock()
+	defer workerMutex.Unlock()
+
+	state, ok := workerTable[id]
+	if !ok {
+		return
+	}
+
+	fmt.Printf("[Supervisor] Evicting worker %d (%s): %s\n",
+		id, state.pWorker.worker.Hostname, reason)
+	delete(workerTable, id)
+	state.cancel()
+}
+
+/** -- fits() -----------------------------------------------------------------
+ *  Returns whether a worker meets the requirements of a job.
+ *
+ *  @param active  The job
+ *  @param reg     The worker's registration
+ *  @param memory  The worker's available memory from its last heartbeat
+ ** ------------------------------------------------------------------------ */
+func fits(active *ActiveJob, reg data.Registration, memory int) bool {
+	req := active.job.Requires
+
+	return reg.Cores >= req.MinCores &&
+		memory >= req.MinMemory &&
+		(active.modelPattern == nil || active.modelPattern.MatchString(reg.ModelName))
+}
+
+/** -- satisfies() ------------------------------------------------------------
+ *  Returns whether a worker slot can run the tasks of a job.
+ *
+ *  @param active   The job
+ *  @param pWorker  The worker slot
+ ** ------------------------------------------------------------------------ */
+func satisfies(active *ActiveJob, pWorker ProtectedWorker) bool {
+	workerMutex.Lock()
+	defer workerMutex.Unlock()
+
+	state, ok := workerTable[pWorker.worker.Id]
+	if !ok {
+		return false
+	}
+	return fits(active, state.reg, state.memAvailable)
+}
+
+/** -- countWorkers() ---------------------------------------------------------
+ *  Returns the number of live workers that can run the tasks of a job.
+ *
+ *  @param active  The job
+ ** ------------------------------------------------------------------------ */
+func countWorkers(active *ActiveJob) int {
+	workerMutex.Lock()
+	defer workerMutex.Unlock()
+
+	count := 0
+	for _, state := range workerTable {
+		if fits(active, state.reg, state.memAvailable) {
+			count++
+		}
+	}
+	return count
+}
+
+/** -- alive() ----------------------------------------------------------------
+ *  Returns whether a worker from the pool has not been evicted.
+ *
+ *  @param pWorker  The worker
+ ** ------------------------------------------------------------------------ */
+func alive(pWorker ProtectedWorker) bool {
+	return pWorker.ctx.Err() == nil
+}
+
+/** -- heartbeatMonitor() -----------------------------------------------------
+ *  Evicts workers that have missed too many heartbeats.
+ ** ------------------------------------------------------------------------ */
+func heartbeatMonitor() {
+	deadline := MISSED_HEARTBEATS * data.HeartbeatInterval
+
+	for range time.Tick(data.HeartbeatInterval) {
+		var dead []int64
+
+		workerMutex.Lock()
+		for id, state := range workerTable {
+			if time.Since(state.lastHeartbeat) > deadline {
+				dead = append(dead, id)
+			}
+		}
+		workerMutex.Unlock()
+
+		for _, id := range dead {
+			evictWorker(id, fmt.Sprintf("missed %d heartbeats", MISSED_HEARTBEATS))
+		}
+	}
+}
+
+/** -- heartbeat() ------------------------------------------------------------
+ *  Handles a heartbeat from a worker. Unknown workers are answered with
+ *  404 so they know to register again. So is a worker whose id was given
+ *  to another host: ids start over when the supervisor restarts.
+ *
+ *  @param w  Write the reply into this writer
+ *  @param r  Information about the request
+ ** ------------------------------------------------------------------------ */
+func heartbeat(w http.ResponseWriter, r *http.Request) {
+	buf, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		replyError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	hb, err := data.JsonToHeartbeat(buf)
+	if err != nil {
+		rejectMessage(w, "heartbeat", err)
+		return
+	}
+
+	workerMutex.Lock()
+	defer workerMutex.Unlock()
+
+	state, ok := workerTable[hb.WorkerId]
+	if !ok || hb.Hostname != state.reg.Hostname {
+		replyError(w, http.StatusNotFound, "unknown worker, register again")
+		return
+	}
+
+	state.lastHeartbeat = time.Now()
+	state.load = hb.Load
+	state.memAvailable = hb.MemAvailable
+
+	/* The worker may meet a job's memory requirement now */
+	taskQueued.Broadcast()
+}
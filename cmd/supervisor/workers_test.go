@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/showalter/bdws/internal/data"
+)
+
+func TestHeartbeatHostname(t *testing.T) {
+	pWorker := addWorker(data.Registration{Hostname: "alpha:5802"})
+	id := pWorker.worker.Id
+	defer evictWorker(id, "test over")
+
+	tests := []struct {
+		name     string
+		id       int64
+		hostname string
+		status   int
+	}{
+		{"registered host", id, "alpha:5802", http.StatusOK},
+		{"no host", id, "", http.StatusNotFound},
+		{"another host with the same id", id, "beta:5802", http.StatusNotFound},
+		{"another port with the same id", id, "alpha:5803", http.StatusNotFound},
+		{"unknown id", id + 1000, "alpha:5802", http.StatusNotFound},
+	}
+
+	for _, test := range tests {
+		hbJson, err := data.HeartbeatToJson(data.Heartbeat{WorkerId: test.id, Hostname: test.hostname})
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		heartbeat(w, httptest.NewRequest(http.MethodPost, "/heartbeat", bytes.NewReader(hbJson)))
+		if w.Code != test.status {
+			t.Errorf("%s: got %d, want %d", test.name, w.Code, test.status)
+		}
+	}
+
+	if !alive(pWorker) {
+		t.Errorf("the worker was evicted by another host's heartbeat")
+	}
+}
@@ -0,0 +1,108 @@
+// This file contains the collection of the files tasks output.
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/showalter/bdws/internal/data"
+)
+
+// Upload the files in a task's working directory that match its job's
+// output patterns to the supervisor, and return the ones that were uploaded.
+// Files that could not be uploaded, also for running out of the task's lease,
+// are reported in the task's stderr.
+func uploadArtifacts(ctx context.Context, job data.Job, workDir string, result *data.TaskResult) []data.Artifact {
+	var artifacts []data.Artifact
+
+	for _, name := range matchOutputs(job.Outputs, workDir) {
+		size, err := uploadArtifact(ctx, job, filepath.Join(workDir, filepath.FromSlash(name)), name)
+		if err != nil {
+			fmt.Printf("[Worker] Could not upload %s of task %s: %v\n", name, job.TaskId, err)
+			result.Stderr += fmt.Sprintf("\n[Worker] Output file %s could not be uploaded: %v", name, err)
+			continue
+		}
+		artifacts = append(artifacts, data.Artifact{Name: name, Size: size})
+	}
+
+	return artifacts
+}
+
+// Find the regular files in a working directory that match any of the output
+// patterns, as slash separated paths within it. Links are not followed, not
+// even to directories, so a task cannot have files outside it uploaded.
+func matchOutputs(patterns []string, workDir string) []string {
+	var names []string
+	seen := make(map[string]bool)
+
+	realDir, err := filepath.EvalSymlinks(workDir)
+	if err != nil {
+		return nil
+	}
+
+	for _, pattern := range patterns {
+		if data.CheckOutputPattern(pattern) != nil {
+			continue
+		}
+		matches, _ := filepath.Glob(filepath.Join(workDir, filepath.FromSlash(pattern)))
+		for _, match := range matches {
+			info, err := os.Lstat(match)
+			if err != nil || !info.Mode().IsRegular() {
+				continue
+			}
+			name, err := filepath.Rel(workDir, match)
+			if err != nil || seen[name] {
+				continue
+			}
+			if real, err := filepath.EvalSymlinks(match); err != nil || real != filepath.Join(realDir, name) {
+				continue
+			}
+			seen[name] = true
+			names = append(names, filepath.ToSlash(name))
+		}
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+// Upload one file a task output and return its size.
+func uploadArtifact(ctx context.Context, job data.Job, path string, name string) (int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	target := fmt.Sprintf("%s/jobs/%d/artifacts/%s/%s", supervisorAddress, job.Id,
+		url.PathEscape(job.TaskId), (&url.URL{Path: name}).EscapedPath())
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, target, file)
+	if err != nil {
+		return 0, err
+	}
+	req.ContentLength = info.Size()
+	req.Header.Set("Content-Type", "application/octet-stream")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		reply, _ := ioutil.ReadAll(resp.Body)
+		return 0, fmt.Errorf("supervisor replied %s: %s", resp.Status, errorMessage(reply))
+	}
+	return info.Size(), nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestMatchOutputs(t *testing.T) {
+	parent, err := ioutil.TempDir("", "bdws-artifacts-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(parent)
+
+	// A working directory and files next to it that a task must not get
+	// uploaded
+	workDir := filepath.Join(parent, "task")
+	outside := filepath.Join(parent, "secret")
+	for _, name := range []string{
+		"task/out.csv", "task/b.csv", "task/notes.txt", "task/plots/a.png", "task/plots/deep/b.png",
+		"task/dir.csv/inside", "secret/key.csv",
+	} {
+		path := filepath.Join(parent, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for link, target := range map[string]string{
+		"link.csv":      filepath.Join(outside, "key.csv"),
+		"relative.csv":  "../secret/key.csv",
+		"escape":        outside,
+		"plots/up":      "..",
+		"plots/out.png": "../out.csv",
+	} {
+		if err := os.Symlink(target, filepath.Join(workDir, filepath.FromSlash(link))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		patterns []string
+		want     []string
+	}{
+		{"no patterns", nil, nil},
+		{"glob", []string{"*.csv"}, []string{"b.csv", "out.csv"}},
+		{"file name", []string{"notes.txt"}, []string{"notes.txt"}},
+		{"subdirectory", []string{"plots/*.png"}, []string{"plots/a.png"}},
+		{"glob of directories", []string{"*/*/*.png"}, []string{"plots/deep/b.png"}},
+		{"sorted without duplicates", []string{"out.csv", "*.csv", "b.csv"}, []string{"b.csv", "out.csv"}},
+		{"no match", []string{"*.json"}, nil},
+		{"directories are not files", []string{"plots", "dir.csv"}, nil},
+		{"parent", []string{"../secret/*.csv"}, nil},
+		{"absolute", []string{filepath.Join(outside, "*.csv")}, nil},
+		{"invalid pattern", []string{"[", "notes.txt"}, []string{"notes.txt"}},
+		{"links to files outside", []string{"link.csv", "relative.csv"}, nil},
+		{"through a link to a directory outside", []string{"escape/*.csv", "escape/key.csv"}, nil},
+		{"through a link to the working directory", []string{"plots/up/*.csv"}, nil},
+		{"link to a file inside", []string{"plots/out.png"}, nil},
+	}
+
+	for _, test := range tests {
+		if got := matchOutputs(test.patterns, workDir); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+	}
+}
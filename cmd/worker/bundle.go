@@ -0,0 +1,142 @@
+// This file contains the unpacking of jobs whose code is a bundle of files.
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/showalter/bdws/internal/data"
+)
+
+// Most bytes the files of a bundle may add up to once unpacked, so a small
+// archive cannot fill the worker's disk
+const MAX_UNPACKED = 1 << 30
+
+// Unpack a bundle into a directory. Only files and directories are
+// unpacked, and none of them may land outside the directory.
+func unpackBundle(code []byte, format string, dir string) error {
+	switch format {
+	case data.BundleTar:
+		return unpackTar(bytes.NewReader(code), dir, MAX_UNPACKED)
+
+	case data.BundleTarGzip:
+		zr, err := gzip.NewReader(bytes.NewReader(code))
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		return unpackTar(zr, dir, MAX_UNPACKED)
+
+	case data.BundleZip:
+		return unpackZip(code, dir, MAX_UNPACKED)
+	}
+
+	return fmt.Errorf("unknown bundle format %q", format)
+}
+
+// Unpack a tar archive into a directory, as long as its files add up to no
+// more than limit bytes.
+func unpackTar(archive io.Reader, dir string, limit int64) error {
+	tr := tar.NewReader(archive)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		name, err := bundlePath(dir, header.Name)
+		if err != nil {
+			return err
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(name, 0777)
+		case tar.TypeReg:
+			var n int64
+			n, err = writeBundleFile(name, tr, os.FileMode(header.Mode), limit)
+			limit -= n
+		case tar.TypeSymlink, tar.TypeLink:
+			err = fmt.Errorf("%s: bundles may not contain links", header.Name)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Unpack a zip archive into a directory, as long as its files add up to no
+// more than limit bytes.
+func unpackZip(code []byte, dir string, limit int64) error {
+	zr, err := zip.NewReader(bytes.NewReader(code), int64(len(code)))
+	if err != nil {
+		return err
+	}
+
+	for _, file := range zr.File {
+		name, err := bundlePath(dir, file.Name)
+		if err != nil {
+			return err
+		}
+
+		if file.FileInfo().IsDir() {
+			if err := os.MkdirAll(name, 0777); err != nil {
+				return err
+			}
+			continue
+		} else if !file.Mode().IsRegular() {
+			return fmt.Errorf("%s: bundles may not contain links", file.Name)
+		}
+
+		contents, err := file.Open()
+		if err != nil {
+			return err
+		}
+		n, err := writeBundleFile(name, contents, file.Mode(), limit)
+		limit -= n
+		contents.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Get where a file of a bundle goes, refusing names that escape the
+// bundle's directory.
+func bundlePath(dir string, name string) (string, error) {
+	clean, err := data.RelativePath(name)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, filepath.FromSlash(clean)), nil
+}
+
+// Write one file of a bundle, keeping whether it is executable, and return
+// its size. Writing stops once the file is larger than limit.
+func writeBundleFile(name string, contents io.Reader, mode os.FileMode, limit int64) (int64, error) {
+	if err := os.MkdirAll(filepath.Dir(name), 0777); err != nil {
+		return 0, err
+	}
+
+	file, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode.Perm()|0600)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(file, io.LimitReader(contents, limit+1))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && n > limit {
+		err = fmt.Errorf("bundle unpacks to more than %d bytes", MAX_UNPACKED)
+	}
+	return n, err
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// One entry of a test archive
+type bundleEntry struct {
+	name     string
+	contents string
+	link     string // Target of a link, for entries that are links
+	hard     bool   // The link is a hard link
+}
+
+func tarBundle(t *testing.T, entries []bundleEntry) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, entry := range entries {
+		header := &tar.Header{Name: entry.name, Mode: 0644, Size: int64(len(entry.contents))}
+		switch {
+		case entry.link != "" && entry.hard:
+			header.Typeflag, header.Linkname, header.Size = tar.TypeLink, entry.link, 0
+		case entry.link != "":
+			header.Typeflag, header.Linkname, header.Size = tar.TypeSymlink, entry.link, 0
+		case strings.HasSuffix(entry.name, "/"):
+			header.Typeflag, header.Mode = tar.TypeDir, 0755
+		default:
+			header.Typeflag = tar.TypeReg
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(entry.contents)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func zipBundle(t *testing.T, entries []bundleEntry) []byte {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, entry := range entries {
+		header := &zip.FileHeader{Name: entry.name, Method: zip.Deflate}
+		contents := entry.contents
+		switch {
+		case entry.link != "":
+			header.SetMode(os.ModeSymlink | 0777)
+			contents = entry.link
+		case strings.HasSuffix(entry.name, "/"):
+			header.SetMode(os.ModeDir | 0755)
+		default:
+			header.SetMode(0644)
+		}
+		w, err := zw.CreateHeader(header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(contents)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestUnpackBundle(t *testing.T) {
+	bomb := strings.Repeat("0", 1<<20)
+	tests := []struct {
+		name    string
+		entries []bundleEntry
+		limit   int64
+		tarOnly bool // Zip archives have no hard links
+		wantErr bool
+	}{
+		{"files", []bundleEntry{{name: "main.py", contents: "print(1)"}, {name: "lib/util.py", contents: "x = 1"}}, 100, false, false},
+		{"directory", []bundleEntry{{name: "data/"}, {name: "data/in.csv", contents: "1,2"}}, 100, false, false},
+		{"dot segments inside", []bundleEntry{{name: "lib/../main.py", contents: "print(1)"}}, 100, false, false},
+		{"parent", []bundleEntry{{name: "../evil", contents: "x"}}, 100, false, true},
+		{"parent after a directory", []bundleEntry{{name: "lib/../../evil", contents: "x"}}, 100, false, true},
+		{"backslash parent", []bundleEntry{{name: "..\\evil", contents: "x"}}, 100, false, true},
+		{"absolute", []bundleEntry{{name: "/tmp/evil", contents: "x"}}, 100, false, true},
+		{"symlink", []bundleEntry{{name: "passwd", link: "/etc/passwd"}}, 100, false, true},
+		{"symlink then file through it", []bundleEntry{{name: "up", link: ".."}, {name: "up/evil", contents: "x"}}, 100, false, true},
+		{"hard link", []bundleEntry{{name: "passwd", link: "/etc/passwd", hard: true}}, 100, true, true},
+		{"exactly the limit", []bundleEntry{{name: "a", contents: "12345"}, {name: "b", contents: "12345"}}, 10, false, false},
+		{"files over the limit", []bundleEntry{{name: "a", contents: "12345"}, {name: "b", contents: "123456"}}, 10, false, true},
+		{"bomb", []bundleEntry{{name: "bomb", contents: bomb}}, 1 << 16, false, true},
+	}
+
+	formats := []struct {
+		name   string
+		unpack func(t *testing.T, entries []bundleEntry, dir string, limit int64) error
+	}{
+		{"tar", func(t *testing.T, entries []bundleEntry, dir string, limit int64) error {
+			return unpackTar(bytes.NewReader(tarBundle(t, entries)), dir, limit)
+		}},
+		{"zip", func(t *testing.T, entries []bundleEntry, dir string, limit int64) error {
+			return unpackZip(zipBundle(t, entries), dir, limit)
+		}},
+	}
+
+	for _, format := range formats {
+		for _, test := range tests {
+			if test.tarOnly && format.name != "tar" {
+				continue
+			}
+
+			// Unpack into a directory of its own, so anything that escapes
+			// it lands next to it
+			parent, err := ioutil.TempDir("", "bdws-bundle-")
+			if err != nil {
+				t.Fatal(err)
+			}
+			dir := filepath.Join(parent, "task")
+
+			err = format.unpack(t, test.entries, dir, test.limit)
+			if test.wantErr && err == nil {
+				t.Errorf("%s %s: unpacked, want an error", format.name, test.name)
+			} else if !test.wantErr && err != nil {
+				t.Errorf("%s %s: %v", format.name, test.name, err)
+			}
+
+			if _, err := os.Stat(filepath.Join(parent, "evil")); err == nil {
+				t.Errorf("%s %s: a file was written outside the directory", format.name, test.name)
+			}
+			if info, err := os.Lstat(filepath.Join(dir, "passwd")); err == nil && info.Mode()&os.ModeSymlink != 0 {
+				t.Errorf("%s %s: a link was unpacked", format.name, test.name)
+			}
+			if !test.wantErr {
+				for _, entry := range test.entries {
+					if strings.HasSuffix(entry.name, "/") {
+						continue
+					}
+					got, err := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(entry.name)))
+					if err != nil || string(got) != entry.contents {
+						t.Errorf("%s %s: %s holds %q (%v), want %q", format.name, test.name, entry.name, got, err, entry.contents)
+					}
+				}
+			}
+			os.RemoveAll(parent)
+		}
+	}
+}
@@ -0,0 +1,219 @@
+// This file contains the worker's content-addressed cache of job code.
+//
+// The supervisor dispatches tasks with the hash of their code. The code is
+// kept in <worker directory>/cache/<hash> and fetched from the supervisor
+// only when it is not there. Each task runs its code from
+// <worker directory>/code/<hash>/<file name>, so anything built next to the
+// source, such as javac's classes, is cached by the hash of the source too.
+// Every task runs in a directory of its own under <worker directory>/tasks,
+// which is also where bundles are unpacked.
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/showalter/bdws/internal/data"
+)
+
+// Directories under the worker directory
+const CACHE_DIR = "cache"
+const CODE_DIR = "code"
+const TASKS_DIR = "tasks"
+
+var supervisorAddress string
+
+var fetchClient = &http.Client{Timeout: data.FetchTimeout}
+
+// A fetch of code in progress
+type codeFetch struct {
+	done      chan struct{}
+	err       error
+	abandoned bool // The task that started the fetch was killed
+}
+
+// Fetches in progress by hash, so tasks of one job arriving together fetch
+// its code once while tasks of other jobs go ahead
+var fetching = make(map[string]*codeFetch)
+var fetchMutex = &sync.Mutex{}
+
+// Make sure a job's code is in the cache, fetching it from the supervisor if
+// it is not. Unless this fails, the caller releases the code with
+// releaseCode() once its task is done. Fetching stops if ctx is cancelled.
+func cacheCode(ctx context.Context, job *data.Job) error {
+	if len(job.Code) > 0 {
+		job.CodeHash = data.HashCode(job.Code)
+	}
+
+	// Jobs such as system programs have no code
+	if job.CodeHash == "" {
+		return nil
+	}
+	if !data.ValidCodeHash(job.CodeHash) {
+		return fmt.Errorf("invalid code hash %q", job.CodeHash)
+	}
+
+	// The code stays in the cache until the task is done with it
+	useCode(job.CodeHash)
+	err := fetchCode(ctx, job.CodeHash, job.Code)
+	if err != nil {
+		releaseCode(job.CodeHash)
+	}
+	return err
+}
+
+// Make a working directory of a task's own and put the task's code where it
+// runs it. Returns the working directory, which the caller retires, and the
+// path of the file to run.
+func prepareTask(job data.Job) (string, string, error) {
+	workDir, err := newTaskDir(job.TaskId)
+	if err != nil {
+		return "", "", err
+	}
+
+	fullName, err := placeCode(job, workDir)
+	if err != nil {
+		retireDir(workDir, true)
+		return "", "", err
+	}
+	return workDir, fullName, nil
+}
+
+// Put a cached job's code where a task runs it and return the path of the
+// file to run.
+func placeCode(job data.Job, workDir string) (string, error) {
+
+	// System programs are found on the path
+	if job.CodeHash == "" {
+		return job.FileName, nil
+	}
+
+	// Tasks may change the files they are given, so each gets its own copy of
+	// a bundle. The entrypoint has to be one of the bundle's files.
+	if job.Bundle != "" {
+		entry, err := bundlePath(workDir, job.FileName)
+		if err != nil {
+			return "", err
+		}
+		code, err := ioutil.ReadFile(cachePath(job.CodeHash))
+		if err != nil {
+			return "", err
+		}
+		if err := unpackBundle(code, job.Bundle, workDir); err != nil {
+			return "", err
+		}
+		if _, err := os.Stat(entry); err != nil {
+			return "", fmt.Errorf("bundle has no file %s", job.FileName)
+		}
+		return entry, nil
+	}
+
+	// A single file is copied out of the cache once, so a task that changes
+	// it cannot corrupt the cache
+	dir := filepath.Join(workerDirectory, CODE_DIR, job.CodeHash)
+	fullName := filepath.Join(dir, filepath.Base(job.FileName))
+	if _, err := os.Stat(fullName); os.IsNotExist(err) {
+		code, err := ioutil.ReadFile(cachePath(job.CodeHash))
+		if err != nil {
+			return "", err
+		}
+		if err := os.MkdirAll(dir, 0777); err != nil {
+			return "", err
+		}
+		if err := createFile(fullName, code); err != nil {
+			return "", err
+		}
+	}
+	return fullName, nil
+}
+
+// Where code with the given hash is cached.
+func cachePath(hash string) string {
+	return filepath.Join(workerDirectory, CACHE_DIR, hash)
+}
+
+// Fetch code from the supervisor unless it is already cached, or wait for
+// the task already fetching it. Code sent inline, e.g. by an older
+// supervisor, is cached like code that was fetched.
+func fetchCode(ctx context.Context, hash string, inline []byte) error {
+	for {
+		fetchMutex.Lock()
+		f, ok := fetching[hash]
+		if !ok {
+			break
+		}
+		fetchMutex.Unlock()
+
+		select {
+		case <-f.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		// Fetch it again if only the task that fetched it gave up
+		if !f.abandoned {
+			return f.err
+		}
+	}
+
+	// Cached code is touched, so the janitor evicts what was used longest ago.
+	// Code is renamed into the cache whole, see createFile().
+	if _, err := os.Stat(cachePath(hash)); err == nil {
+		fetchMutex.Unlock()
+		now := time.Now()
+		os.Chtimes(cachePath(hash), now, now)
+		return nil
+	}
+
+	f := &codeFetch{done: make(chan struct{})}
+	fetching[hash] = f
+	fetchMutex.Unlock()
+
+	if len(inline) > 0 {
+		f.err = createFile(cachePath(hash), inline)
+	} else {
+		f.err = downloadCode(ctx, hash)
+		f.abandoned = f.err != nil && ctx.Err() != nil
+	}
+
+	fetchMutex.Lock()
+	delete(fetching, hash)
+	fetchMutex.Unlock()
+	close(f.done)
+	return f.err
+}
+
+// Download code from the supervisor into the cache.
+func downloadCode(ctx context.Context, hash string) error {
+
+	fmt.Printf("[Worker] Fetching code %s\n", hash)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, supervisorAddress+"/code/"+hash, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := fetchClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("fetching code: %v", err)
+	}
+	defer resp.Body.Close()
+
+	code, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("fetching code: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("supervisor could not send code %s (%s): %s", hash, resp.Status, errorMessage(code))
+	}
+
+	// Never cache code under the wrong name
+	if data.HashCode(code) != hash {
+		return fmt.Errorf("code fetched for %s has the wrong hash", hash)
+	}
+
+	return createFile(cachePath(hash), code)
+}
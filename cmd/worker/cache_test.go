@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/showalter/bdws/internal/data"
+)
+
+// Point the worker at a temporary directory and a supervisor that serves
+// the given code, holding back the code whose hash is in stall until it is
+// closed.
+func fakeSupervisor(t *testing.T, code map[string][]byte, stall map[string]chan struct{}) func() {
+	dir, err := ioutil.TempDir("", "bdws-worker-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(dir, CACHE_DIR), 0755); err != nil {
+		t.Fatal(err)
+	}
+	workerDirectory = dir
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hash := strings.TrimPrefix(r.URL.Path, "/code/")
+		if release, ok := stall[hash]; ok {
+			select {
+			case <-release:
+			case <-r.Context().Done():
+				return
+			}
+		}
+		w.Write(code[hash])
+	}))
+	supervisorAddress = server.URL
+
+	return func() {
+		server.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestFetchCodeStallsOnlyItsHash(t *testing.T) {
+	slow, fast := []byte("echo slow"), []byte("echo fast")
+	slowHash, fastHash := data.HashCode(slow), data.HashCode(fast)
+	release := make(chan struct{})
+	defer fakeSupervisor(t, map[string][]byte{slowHash: slow, fastHash: fast},
+		map[string]chan struct{}{slowHash: release})()
+
+	first := make(chan error, 1)
+	go func() { first <- fetchCode(context.Background(), slowHash, nil) }()
+	time.Sleep(50 * time.Millisecond)
+
+	// Other code is fetched while the stalled fetch is in progress
+	done := make(chan error, 1)
+	go func() { done <- fetchCode(context.Background(), fastHash, nil) }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("fetching other code waited for the stalled fetch")
+	}
+
+	// A killed task stops waiting for the fetch it joined
+	ctx, cancel := context.WithCancel(context.Background())
+	waiter := make(chan error, 1)
+	go func() { waiter <- fetchCode(ctx, slowHash, nil) }()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-waiter:
+		if err != context.Canceled {
+			t.Errorf("killed waiter got %v, want %v", err, context.Canceled)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("killed waiter kept waiting for the fetch")
+	}
+
+	// Tasks that joined the fetch get its outcome
+	second := make(chan error, 1)
+	go func() { second <- fetchCode(context.Background(), slowHash, nil) }()
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	for _, result := range []chan error{first, second} {
+		if err := <-result; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if cached, err := ioutil.ReadFile(cachePath(slowHash)); err != nil || string(cached) != string(slow) {
+		t.Errorf("cached code is %q (%v), want %q", cached, err, slow)
+	}
+}
+
+func TestFetchCodeAfterAbandonedFetch(t *testing.T) {
+	code := []byte("echo again")
+	hash := data.HashCode(code)
+	release := make(chan struct{})
+	defer fakeSupervisor(t, map[string][]byte{hash: code}, map[string]chan struct{}{hash: release})()
+
+	// The task that started the fetch is killed while another waits for it
+	ctx, cancel := context.WithCancel(context.Background())
+	first := make(chan error, 1)
+	go func() { first <- fetchCode(ctx, hash, nil) }()
+	time.Sleep(50 * time.Millisecond)
+
+	second := make(chan error, 1)
+	go func() { second <- fetchCode(context.Background(), hash, nil) }()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	if err := <-first; err == nil {
+		t.Fatal("killed fetch succeeded")
+	}
+
+	// The waiter fetches the code itself
+	close(release)
+	if err := <-second; err != nil {
+		t.Fatalf("waiter got %v after the fetch it joined was abandoned", err)
+	}
+}
@@ -0,0 +1,82 @@
+// This file contains the handling of the processes a task starts.
+//
+// Every task's program is started in a process group of its own, so it and
+// everything it starts can be signalled at once. Once the program exits,
+// whatever it left running in its group is ended as well: asked to stop with
+// SIGTERM, then killed with SIGKILL after KILL_GRACE. On Linux the worker is
+// a child subreaper, so the processes a task orphans become the worker's and
+// are reaped and counted here. A process that leaves its task's group, with
+// setsid for example, is only ended by a cgroup or isolation. Windows has
+// neither process groups nor signals, so there the program is killed outright
+// and whatever it started is left alone.
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// How often a process group is checked for processes while it is ending
+const GROUP_POLL = 50 * time.Millisecond
+
+// Closed when the worker is shutting down
+var shutdown = make(chan struct{})
+
+// Tell whether the worker is shutting down.
+func shuttingDown() bool {
+	select {
+	case <-shutdown:
+		return true
+	default:
+		return false
+	}
+}
+
+// Read all of one of a task's pipes in the background, handing the output
+// to what keeps it. The channel is closed once the pipe is closed at the
+// other end, or this end is.
+func readPipe(pipe *os.File, output io.Writer) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		io.Copy(output, pipe)
+		close(done)
+	}()
+	return done
+}
+
+// End every running task when the worker is told to stop, then stop the way
+// it was told to. The tasks' results are not sent, so the supervisor runs
+// them again elsewhere.
+func stopOnSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	received := <-signals
+
+	fmt.Printf("[Worker] Got %v, ending running tasks\n", received)
+	close(shutdown)
+	tasksMutex.Lock()
+	for _, kill := range runningTasks {
+		kill()
+	}
+	tasksMutex.Unlock()
+
+	// Ending a task takes at most KILL_GRACE for its program and twice that
+	// for what it left behind
+	deadline := time.Now().Add(3 * KILL_GRACE)
+	for time.Now().Before(deadline) {
+		tasksMutex.Lock()
+		running := len(runningTasks)
+		tasksMutex.Unlock()
+		if running == 0 {
+			break
+		}
+		time.Sleep(GROUP_POLL)
+	}
+
+	signal.Reset(received)
+	raise(received)
+}
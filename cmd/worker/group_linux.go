@@ -0,0 +1,17 @@
+package main
+
+import (
+	"syscall"
+)
+
+// prctl option missing from the syscall package
+const PR_SET_CHILD_SUBREAPER = 36
+
+// Make the processes that tasks orphan the worker's children, so they can
+// be reaped and counted.
+func becomeSubreaper() error {
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, PR_SET_CHILD_SUBREAPER, 1, 0); errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+// Start a command in a process group of its own.
+func newGroup(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+}
+
+// Signal every process of a process group.
+func signalGroup(pgid int, signal syscall.Signal) error {
+	return syscall.Kill(-pgid, signal)
+}
+
+// End what is left of a task's process group after its program exited, and
+// return how many processes the worker reaped from it.
+func endGroup(pgid int) int {
+	reaped := 0
+	reap := func() {
+		for {
+			pid, err := syscall.Wait4(-pgid, nil, syscall.WNOHANG, nil)
+			if err != nil || pid <= 0 {
+				return
+			}
+			reaped++
+		}
+	}
+
+	// Give what is left a chance to stop, then kill it. Processes that did
+	// not become the worker's are reaped by someone else, which may take a
+	// moment, so that is not waited on forever.
+	signals := []syscall.Signal{syscall.SIGTERM, syscall.SIGKILL}
+	for _, signal := range signals {
+		reap()
+		if signalGroup(pgid, signal) != nil {
+			return reaped
+		}
+		deadline := time.Now().Add(KILL_GRACE)
+		for time.Now().Before(deadline) {
+			time.Sleep(GROUP_POLL)
+			reap()
+			if signalGroup(pgid, 0) != nil {
+				return reaped
+			}
+		}
+	}
+	reap()
+	return reaped
+}
+
+// Send the worker itself a signal.
+func raise(signal os.Signal) {
+	syscall.Kill(os.Getpid(), signal.(syscall.Signal))
+}
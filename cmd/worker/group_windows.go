@@ -0,0 +1,31 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// There are no process groups to start a command in.
+func newGroup(cmd *exec.Cmd) {
+}
+
+// Kill the program whose pid names the group, whatever the signal: it cannot
+// be asked to stop.
+func signalGroup(pgid int, signal syscall.Signal) error {
+	process, err := os.FindProcess(pgid)
+	if err != nil {
+		return err
+	}
+	return process.Kill()
+}
+
+// Nothing is known to be left of a task once its program exited.
+func endGroup(pgid int) int {
+	return 0
+}
+
+// Stop the worker the way a signal would.
+func raise(signal os.Signal) {
+	os.Exit(1)
+}
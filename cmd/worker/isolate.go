@@ -0,0 +1,73 @@
+// This file contains the isolation of tasks from the worker's machine.
+//
+// With -isolate every task runs in new user, mount, PID and network
+// namespaces, which an unprivileged user can make. The launcher then builds
+// the task a root of its own: the system directories read-only, the task's
+// working directory and the code it runs, a private /tmp, a few devices and
+// the task's own /proc. Home directories, other tasks and the rest of the
+// worker directory cannot be seen. The launcher stays on as the init of the
+// task's PID namespace, passing signals on to the task's program, so
+// whatever the program starts is killed when it exits. Unless
+// -share-network is given the task only has a loopback interface.
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// Whether tasks run in namespaces of their own
+var isolateTasks bool
+
+// Whether isolated tasks keep the worker's network
+var shareNetwork bool
+
+// Directories of the system an isolated task sees, read-only, if they exist
+var systemDirs = []string{"/usr", "/bin", "/sbin", "/lib", "/lib32", "/lib64", "/libx32", "/etc", "/opt"}
+
+// Devices an isolated task may use
+var taskDevices = []string{"null", "zero", "full", "random", "urandom"}
+
+// What an isolated task sees of the worker's machine
+type isolation struct {
+	Dir     string // The task's working directory
+	Binds   []bind // Directories of the worker the task sees
+	Network bool   // Whether the task keeps the worker's network
+}
+
+// A directory of the worker that an isolated task sees at the same path
+type bind struct {
+	Path     string
+	Writable bool
+}
+
+// Tell what a task sees of the machine, or nil if tasks are not isolated.
+func taskIsolation(env taskEnv) *isolation {
+	if !isolateTasks {
+		return nil
+	}
+
+	spec := &isolation{
+		Dir:     env.dir,
+		Binds:   []bind{{Path: env.dir, Writable: true}},
+		Network: shareNetwork,
+	}
+	if env.code != "" {
+		spec.Binds = append(spec.Binds, bind{Path: env.code, Writable: env.writeCode})
+	}
+	return spec
+}
+
+// Make sure tasks can be isolated on this machine by launching one that does
+// nothing.
+func checkIsolation() error {
+	env := taskEnv{dir: filepath.Join(workerDirectory, TASKS_DIR)}
+	cmd := limitedCommand(env, "true")
+	defer cmd.close()
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// prctl options and secure bits missing from the syscall package
+const (
+	PR_SET_SECUREBITS    = 28
+	PR_SET_NO_NEW_PRIVS  = 38
+	SECBIT_NOROOT        = 1 << 0
+	SECBIT_NOROOT_LOCKED = 1 << 1
+)
+
+// Mount flags a bind mount keeps when it is made read-only
+const lockedMountFlags = syscall.MS_NOSUID | syscall.MS_NODEV | syscall.MS_NOEXEC |
+	syscall.MS_NOATIME | syscall.MS_NODIRATIME | syscall.MS_RELATIME
+
+// Start a task's launcher in namespaces of its own, as root of its user
+// namespace, which is the worker's user outside it.
+func isolateCommand(cmd *exec.Cmd, spec *isolation) {
+	flags := syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS | syscall.CLONE_NEWPID
+	if !spec.Network {
+		flags |= syscall.CLONE_NEWNET
+	}
+
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags:                 uintptr(flags),
+		UidMappings:                []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getuid(), Size: 1}},
+		GidMappings:                []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getgid(), Size: 1}},
+		GidMappingsEnableSetgroups: false,
+	}
+}
+
+// Give the launcher its own root and drop the privileges it had to make it.
+// The launcher is already in the task's namespaces.
+func isolate(spec *isolation) error {
+
+	// Nothing mounted here may show up on the worker's machine
+	if err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+		return fmt.Errorf("making mounts private: %v", err)
+	}
+
+	// Hold on to the directories the task sees, which the new /tmp may hide
+	binds := make([]*os.File, len(spec.Binds))
+	for i, b := range spec.Binds {
+		dir, err := os.Open(b.Path)
+		if err != nil {
+			return err
+		}
+		defer dir.Close()
+		binds[i] = dir
+	}
+
+	// Build the root in a tmpfs
+	root := "/tmp"
+	if err := mountTmpfs(root, "0755"); err != nil {
+		return err
+	}
+	for _, dir := range []string{"proc", "tmp", "dev", ".oldroot"} {
+		if err := os.Mkdir(filepath.Join(root, dir), 0755); err != nil {
+			return err
+		}
+	}
+	if err := mountTmpfs(filepath.Join(root, "tmp"), "1777"); err != nil {
+		return err
+	}
+
+	for _, dir := range systemDirs {
+		info, err := os.Lstat(dir)
+		if err != nil {
+			continue
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			// Such as /bin on systems that keep everything in /usr
+			target, err := os.Readlink(dir)
+			if err != nil {
+				return err
+			}
+			if err := os.Symlink(target, filepath.Join(root, dir)); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := os.Mkdir(filepath.Join(root, dir), 0755); err != nil {
+			return err
+		}
+		if err := bindMount(dir, filepath.Join(root, dir), false); err != nil {
+			return err
+		}
+	}
+
+	for i, b := range spec.Binds {
+		target := filepath.Join(root, b.Path)
+		if err := os.MkdirAll(target, 0755); err != nil {
+			return err
+		}
+		source := fmt.Sprintf("/proc/self/fd/%d", binds[i].Fd())
+		if err := bindMount(source, target, b.Writable); err != nil {
+			return err
+		}
+	}
+
+	for _, device := range taskDevices {
+		target := filepath.Join(root, "dev", device)
+		file, err := os.Create(target)
+		if err != nil {
+			return err
+		}
+		file.Close()
+		if err := bindMount(filepath.Join("/dev", device), target, true); err != nil {
+			return err
+		}
+	}
+	for name, target := range map[string]string{
+		"fd":     "/proc/self/fd",
+		"stdin":  "/proc/self/fd/0",
+		"stdout": "/proc/self/fd/1",
+		"stderr": "/proc/self/fd/2",
+	} {
+		if err := os.Symlink(target, filepath.Join(root, "dev", name)); err != nil {
+			return err
+		}
+	}
+
+	// The task sees the processes of its own PID namespace only
+	proc := filepath.Join(root, "proc")
+	if err := syscall.Mount("proc", proc, "proc", syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, ""); err != nil {
+		return fmt.Errorf("mounting /proc: %v", err)
+	}
+
+	// Switch to the new root and let go of the old one
+	if err := syscall.PivotRoot(root, filepath.Join(root, ".oldroot")); err != nil {
+		return fmt.Errorf("changing root: %v", err)
+	}
+	if err := syscall.Unmount("/.oldroot", syscall.MNT_DETACH); err != nil {
+		return fmt.Errorf("unmounting the old root: %v", err)
+	}
+	if err := os.Remove("/.oldroot"); err != nil {
+		return err
+	}
+	if err := syscall.Mount("", "/", "", syscall.MS_BIND|syscall.MS_REMOUNT|syscall.MS_RDONLY|syscall.MS_NOSUID|syscall.MS_NODEV, ""); err != nil {
+		return fmt.Errorf("making the root read-only: %v", err)
+	}
+	if err := os.Chdir(spec.Dir); err != nil {
+		return err
+	}
+
+	if !spec.Network {
+		if err := loopbackUp(); err != nil {
+			return fmt.Errorf("bringing up the loopback interface: %v", err)
+		}
+	}
+
+	// The task runs as root of its user namespace, but without any of the
+	// capabilities that would let it undo the above, nor gain others from
+	// setuid programs
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, PR_SET_NO_NEW_PRIVS, 1, 0); errno != 0 {
+		return fmt.Errorf("setting no_new_privs: %v", errno)
+	}
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, PR_SET_SECUREBITS, SECBIT_NOROOT|SECBIT_NOROOT_LOCKED, 0); errno != 0 {
+		return fmt.Errorf("setting securebits: %v", errno)
+	}
+	return nil
+}
+
+// Signals an isolated task's init passes on to the task's program. The
+// first process of a PID namespace only gets the signals it handles, so
+// without an init a program that does not handle SIGTERM would only be
+// stopped by SIGKILL.
+var forwardedSignals = []os.Signal{
+	syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP, syscall.SIGQUIT, syscall.SIGUSR1, syscall.SIGUSR2,
+}
+
+// Act as the init of an isolated task: launch the task's program, without
+// the isolation the init has already done, in a process group of its own,
+// pass the signals that stop tasks on to that group and reap whatever is
+// orphaned. Once the program exits, its wait status is written to STATUS_FD,
+// since the init cannot be ended by the program's signal, and the init exits
+// the same way otherwise, which kills what is left in the namespace. Only
+// returns if the program could not be started.
+//
+// The init's threads count as processes of the task's user and cgroup, so
+// the task's process limits, including the cgroup's pids.max if given, are
+// raised by as many.
+func runInit(spec launchSpec, pidsMax *os.File, args []string) error {
+	signals := make(chan os.Signal, 16)
+	signal.Notify(signals, append(forwardedSignals, syscall.SIGCHLD)...)
+
+	threads, err := ioutil.ReadDir("/proc/self/task")
+	if err != nil {
+		return err
+	}
+	if spec.Processes > 0 {
+		spec.Processes += uint64(len(threads))
+	}
+	if pidsMax != nil {
+		if err := raiseLimit(pidsMax, len(threads)); err != nil {
+			return fmt.Errorf("raising pids.max: %v", err)
+		}
+		pidsMax.Close()
+	}
+
+	// The program is launched again for its limits, which the init is
+	// better off without. The worker's executable is no longer in sight.
+	spec.Cgroup, spec.Isolation = "", nil
+	specJson, err := json.Marshal(spec)
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command("/proc/self/exe", append([]string{LAUNCH_COMMAND, string(specJson)}, args...)...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	pid := cmd.Process.Pid
+
+	for received := range signals {
+		if received != syscall.SIGCHLD {
+			syscall.Kill(-pid, received.(syscall.Signal))
+			continue
+		}
+		for {
+			var status syscall.WaitStatus
+			reaped, err := syscall.Wait4(-1, &status, syscall.WNOHANG, nil)
+			if err != nil || reaped <= 0 {
+				break
+			}
+			if reaped != pid {
+				continue
+			}
+
+			statusFile := os.NewFile(STATUS_FD, "status")
+			statusFile.WriteString(strconv.FormatUint(uint64(status), 10))
+			statusFile.Close()
+			if status.Signaled() {
+				os.Exit(128 + int(status.Signal()))
+			}
+			os.Exit(status.ExitStatus())
+		}
+	}
+	return nil
+}
+
+// Raise a cgroup limit such as pids.max, unless there is none.
+func raiseLimit(file *os.File, by int) error {
+	value, err := ioutil.ReadAll(file)
+	if err != nil {
+		return err
+	}
+	limit, err := strconv.Atoi(strings.TrimSpace(string(value)))
+	if err != nil {
+		return nil
+	}
+	_, err = file.WriteAt([]byte(strconv.Itoa(limit+by)), 0)
+	return err
+}
+
+// Mount a tmpfs.
+func mountTmpfs(target string, mode string) error {
+	if err := syscall.Mount("tmpfs", target, "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, "mode="+mode); err != nil {
+		return fmt.Errorf("mounting a tmpfs on %s: %v", target, err)
+	}
+	return nil
+}
+
+// Mount a file or directory somewhere else as well, read-only unless it is
+// writable.
+func bindMount(source string, target string, writable bool) error {
+	if err := syscall.Mount(source, target, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+		return fmt.Errorf("mounting %s: %v", source, err)
+	}
+	if writable {
+		return nil
+	}
+
+	// A remount has to keep the flags the mount came with
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(target, &stat); err != nil {
+		return err
+	}
+	flags := uintptr(stat.Flags) & lockedMountFlags
+	if err := syscall.Mount("", target, "", syscall.MS_BIND|syscall.MS_REMOUNT|syscall.MS_RDONLY|flags, ""); err != nil {
+		return fmt.Errorf("making %s read-only: %v", source, err)
+	}
+	return nil
+}
+
+// Bring up the loopback interface of a new network namespace, so a task can
+// still talk to itself.
+func loopbackUp() error {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+
+	// struct ifreq, with the flags in its union
+	var request struct {
+		name  [syscall.IFNAMSIZ]byte
+		flags uint16
+		_     [22]byte
+	}
+	copy(request.name[:], "lo")
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.SIOCGIFFLAGS, uintptr(unsafe.Pointer(&request))); errno != 0 {
+		return errno
+	}
+	request.flags |= syscall.IFF_UP
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.SIOCSIFFLAGS, uintptr(unsafe.Pointer(&request))); errno != 0 {
+		return errno
+	}
+	return nil
+}
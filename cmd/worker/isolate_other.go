@@ -0,0 +1,24 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+// Namespaces are only on Linux, so there is nothing to start a task in.
+func isolateCommand(cmd *exec.Cmd, spec *isolation) {
+}
+
+// Isolate the launcher, which cannot be done here.
+func isolate(spec *isolation) error {
+	return fmt.Errorf("tasks can only be isolated on Linux")
+}
+
+// Run a task's program under an init, which is only needed on Linux.
+func runInit(spec launchSpec, pidsMax *os.File, args []string) error {
+	return fmt.Errorf("tasks can only be isolated on Linux")
+}
@@ -0,0 +1,222 @@
+// This file contains the cleanup of the worker directory.
+//
+// A task's working directory is removed when the task exits, unless its
+// retention says to keep it for a while, which by default is only the case
+// for failed tasks so they can be inspected. A kept directory is renamed to
+// say how the task ended. The janitor deletes kept directories once their
+// retention is up, and enforces the worker's disk quota by deleting kept
+// directories and then cached code that no running task uses, oldest first.
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How often the janitor looks at the worker directory
+const JANITOR_INTERVAL = time.Minute
+
+// Suffixes of the working directories of finished tasks that are kept
+const SUCCEEDED_SUFFIX = ".ok"
+const FAILED_SUFFIX = ".failed"
+
+// How long the working directories of finished tasks are kept
+var keepSucceeded time.Duration
+var keepFailed time.Duration
+
+// Bytes the worker directory may use, 0 for no limit
+var diskQuota int64
+
+// Working directories of running tasks and the code they use, which the
+// janitor never touches
+var activeDirs = make(map[string]bool)
+var codeInUse = make(map[string]int)
+var janitorMutex = &sync.Mutex{}
+
+// Make a working directory for a task and mark it as in use.
+func newTaskDir(taskId string) (string, error) {
+	janitorMutex.Lock()
+	defer janitorMutex.Unlock()
+
+	dir, err := ioutil.TempDir(filepath.Join(workerDirectory, TASKS_DIR), taskId+"-")
+	if err == nil {
+		activeDirs[dir] = true
+	}
+	return dir, err
+}
+
+// Mark code as in use by a task, so it is not evicted from the cache.
+func useCode(hash string) {
+	janitorMutex.Lock()
+	defer janitorMutex.Unlock()
+	codeInUse[hash]++
+}
+
+// Mark code as no longer in use by a task.
+func releaseCode(hash string) {
+	janitorMutex.Lock()
+	defer janitorMutex.Unlock()
+	if codeInUse[hash]--; codeInUse[hash] <= 0 {
+		delete(codeInUse, hash)
+	}
+}
+
+// Remove the working directory of a finished task, or keep it for as long as
+// the retention for how the task ended says.
+func retireDir(dir string, failed bool) {
+	janitorMutex.Lock()
+	defer janitorMutex.Unlock()
+	delete(activeDirs, dir)
+
+	keep, suffix := keepSucceeded, SUCCEEDED_SUFFIX
+	if failed {
+		keep, suffix = keepFailed, FAILED_SUFFIX
+	}
+	if keep <= 0 {
+		os.RemoveAll(dir)
+		return
+	}
+
+	// The name says how the task ended and the time says when
+	now := time.Now()
+	os.Chtimes(dir, now, now)
+	if err := os.Rename(dir, dir+suffix); err != nil {
+		fmt.Printf("[Worker] Could not keep %s: %v\n", dir, err)
+		os.RemoveAll(dir)
+	}
+}
+
+// Clean up the worker directory now and then.
+func janitor() {
+	for {
+		cleanUp()
+		time.Sleep(JANITOR_INTERVAL)
+	}
+}
+
+// A file or directory the janitor may delete
+type disposable struct {
+	paths   []string // Deleted together
+	hash    string   // The code it holds, if it is cached code
+	size    int64
+	modTime time.Time
+}
+
+// Delete kept working directories whose retention is up, then delete the
+// oldest kept directories and unused code until the worker directory is
+// within its quota.
+func cleanUp() {
+	now := time.Now()
+	tasksDir := filepath.Join(workerDirectory, TASKS_DIR)
+
+	// Take stock of what is in use while no task can start or finish
+	janitorMutex.Lock()
+	taskEntries, _ := ioutil.ReadDir(tasksDir)
+	codeEntries, _ := ioutil.ReadDir(filepath.Join(workerDirectory, CACHE_DIR))
+	active := make(map[string]bool)
+	for dir := range activeDirs {
+		active[dir] = true
+	}
+	janitorMutex.Unlock()
+
+	var running []string
+	var kept, code []disposable
+
+	// Directories left behind by a worker that died count as failed
+	for _, entry := range taskEntries {
+		path := filepath.Join(tasksDir, entry.Name())
+		if active[path] {
+			running = append(running, path)
+			continue
+		}
+
+		keep := keepFailed
+		if strings.HasSuffix(entry.Name(), SUCCEEDED_SUFFIX) {
+			keep = keepSucceeded
+		}
+		if now.Sub(entry.ModTime()) >= keep {
+			fmt.Printf("[Worker] Removing %s, its retention is up\n", entry.Name())
+			os.RemoveAll(path)
+			continue
+		}
+		kept = append(kept, disposable{paths: []string{path}, modTime: entry.ModTime()})
+	}
+
+	// Sizing everything means reading every directory under it, which is
+	// only worth it with a quota to keep to
+	if diskQuota <= 0 {
+		return
+	}
+
+	// Cached code goes together with the copy tasks run. Code is touched
+	// whenever a task uses it, so the oldest was used longest ago.
+	for _, entry := range codeEntries {
+		hash := entry.Name()
+		paths := []string{cachePath(hash), filepath.Join(workerDirectory, CODE_DIR, hash)}
+		code = append(code, disposable{paths: paths, hash: hash, modTime: entry.ModTime()})
+	}
+
+	// Evict kept directories before code, which is expensive to fetch again
+	sort.Slice(kept, func(i, j int) bool { return kept[i].modTime.Before(kept[j].modTime) })
+	sort.Slice(code, func(i, j int) bool { return code[i].modTime.Before(code[j].modTime) })
+	candidates := append(kept, code...)
+
+	var used int64
+	for _, path := range running {
+		used += diskUsage(path)
+	}
+	for i := range candidates {
+		for _, path := range candidates[i].paths {
+			candidates[i].size += diskUsage(path)
+		}
+		used += candidates[i].size
+	}
+
+	for _, c := range candidates {
+		if used <= diskQuota {
+			return
+		}
+		if evict(c) {
+			used -= c.size
+		}
+	}
+
+	if used > diskQuota {
+		fmt.Printf("[Worker] Running tasks use %d bytes, over the disk quota of %d\n", used, diskQuota)
+	}
+}
+
+// Delete something to get under the disk quota, unless it is code a task
+// started using since the janitor took stock.
+func evict(c disposable) bool {
+	janitorMutex.Lock()
+	defer janitorMutex.Unlock()
+
+	if c.hash != "" && codeInUse[c.hash] > 0 {
+		return false
+	}
+
+	fmt.Printf("[Worker] Over the disk quota, removing %s\n", c.paths[0])
+	for _, path := range c.paths {
+		os.RemoveAll(path)
+	}
+	return true
+}
+
+// Get the bytes used by the files under a path.
+func diskUsage(path string) int64 {
+	var size int64
+	filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
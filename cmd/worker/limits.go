@@ -0,0 +1,229 @@
+// This file contains the resource limits of tasks.
+//
+// A task's program is not started directly. The worker starts itself as a
+// launcher, which moves into the task's cgroup, sets the task's rlimits and
+// then executes the program, so the program and everything it starts are
+// limited from their first instruction. The launcher of an isolated task
+// stays on as the init of its PID namespace and launches the program again,
+// see runInit().
+//
+// With -cgroup the worker makes a cgroup v2 for every task under the given
+// directory, which has to be writable by the worker and not hold the
+// worker's own process. Memory and process limits are then enforced by the
+// cgroup's memory.max and pids.max; otherwise they fall back to the address
+// space and process count rlimits. CPU time and open files are always
+// rlimits.
+//
+// Tasks are only limited on Linux. Elsewhere a task with limits fails to
+// launch and is reported as not run.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/showalter/bdws/internal/data"
+)
+
+// The first argument that makes the worker act as a launcher
+const LAUNCH_COMMAND = "__launch"
+
+// Where the init of an isolated task writes how the task's program ended,
+// see runInit()
+const STATUS_FD = 3
+
+// The worker's executable, which launches tasks
+var launcherPath string
+
+// Where task cgroups are made, or empty to use rlimits only
+var cgroupRoot string
+
+// Controllers enabled for task cgroups
+var cgroupControllers = make(map[string]bool)
+
+// Where a task runs and what it may use
+type taskEnv struct {
+	jobId     int
+	taskId    string
+	dir       string // The task's working directory
+	code      string // The directory of code the task runs, if outside dir
+	writeCode bool   // Whether the task may write to code, to compile it
+	limits    data.Limits
+	cgroup    string // The task's cgroup, if tasks get one
+	log       *taskLog
+	lease     context.Context // Ends when the supervisor gives up on the task
+}
+
+// What the launcher does before it executes a task's program
+type launchSpec struct {
+	Cgroup       string
+	CpuTime      uint64 // Seconds
+	AddressSpace uint64 // Bytes
+	OpenFiles    uint64
+	Processes    uint64
+	Isolation    *isolation // What the task sees, if it is isolated
+}
+
+// A command that runs a program as a task
+type taskCommand struct {
+	*exec.Cmd
+	status      *os.File // What the init of an isolated task writes to
+	statusWrite *os.File
+}
+
+// Make the worker's cgroup directory ready for task cgroups, enabling the
+// memory and pids controllers where the system allows it.
+func setupCgroup(root string) error {
+	if _, err := os.Stat(filepath.Join(root, "cgroup.controllers")); err != nil {
+		return fmt.Errorf("%s is not a cgroup v2 directory", root)
+	}
+
+	available, err := ioutil.ReadFile(filepath.Join(root, "cgroup.controllers"))
+	if err != nil {
+		return err
+	}
+	for _, controller := range []string{"memory", "pids"} {
+		if !contains(strings.Fields(string(available)), controller) {
+			fmt.Printf("[Worker] The %s controller is not available in %s, using rlimits instead\n", controller, root)
+			continue
+		}
+		control := filepath.Join(root, "cgroup.subtree_control")
+		if err := ioutil.WriteFile(control, []byte("+"+controller), 0644); err != nil {
+			fmt.Printf("[Worker] Could not enable the %s controller in %s, using rlimits instead: %v\n", controller, root, err)
+			continue
+		}
+		cgroupControllers[controller] = true
+	}
+
+	// Make sure task cgroups can be made
+	probe := filepath.Join(root, fmt.Sprintf("probe-%d", os.Getpid()))
+	if err := os.Mkdir(probe, 0755); err != nil {
+		return err
+	}
+	os.Remove(probe)
+
+	cgroupRoot = root
+	return nil
+}
+
+// Tell whether a list holds a string.
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Make the cgroup of a task with its limits.
+func newCgroup(taskId string, limits data.Limits) (string, error) {
+	dir, err := ioutil.TempDir(cgroupRoot, taskId+"-")
+	if err != nil {
+		return "", err
+	}
+
+	if limits.Memory > 0 && cgroupControllers["memory"] {
+		err = writeCgroup(dir, "memory.max", strconv.FormatInt(limits.Memory, 10))
+		if err == nil {
+			// Without swap the limit is the memory the task may use
+			writeCgroup(dir, "memory.swap.max", "0")
+		}
+	}
+	if err == nil && limits.Processes > 0 && cgroupControllers["pids"] {
+		err = writeCgroup(dir, "pids.max", strconv.Itoa(limits.Processes))
+	}
+	if err != nil {
+		os.Remove(dir)
+		return "", err
+	}
+	return dir, nil
+}
+
+// Remove the cgroup of a task, killing anything the task left running in it.
+func removeCgroup(dir string) {
+	writeCgroup(dir, "cgroup.kill", "1")
+	if err := os.Remove(dir); err != nil {
+		fmt.Printf("[Worker] Could not remove cgroup %s: %v\n", dir, err)
+	}
+}
+
+// Write a value to a cgroup interface file.
+func writeCgroup(dir string, file string, value string) error {
+	return ioutil.WriteFile(filepath.Join(dir, file), []byte(value), 0644)
+}
+
+// Read a counter from a cgroup events file such as memory.events.
+func cgroupEvent(dir string, file string, key string) int {
+	events, err := ioutil.ReadFile(filepath.Join(dir, file))
+	if err != nil {
+		return 0
+	}
+	for _, line := range strings.Split(string(events), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == key {
+			n, _ := strconv.Atoi(fields[1])
+			return n
+		}
+	}
+	return 0
+}
+
+// Make the command that runs a program as a task: through the launcher if
+// the task has limits, a cgroup or is isolated, otherwise directly. The
+// caller closes it once it is done with it.
+func limitedCommand(env taskEnv, command string, args ...string) *taskCommand {
+	spec := launchSpec{Cgroup: env.cgroup, Isolation: taskIsolation(env)}
+	if env.limits.CpuTime > 0 {
+		// Round up, since a limit of 0 seconds would not be a limit
+		spec.CpuTime = uint64((env.limits.CpuTime + 999999999) / 1000000000)
+	}
+	if env.limits.Memory > 0 && !(env.cgroup != "" && cgroupControllers["memory"]) {
+		spec.AddressSpace = uint64(env.limits.Memory)
+	}
+	if env.limits.OpenFiles > 0 {
+		spec.OpenFiles = uint64(env.limits.OpenFiles)
+	}
+	if env.limits.Processes > 0 && !(env.cgroup != "" && cgroupControllers["pids"]) {
+		spec.Processes = uint64(env.limits.Processes)
+	}
+
+	if spec == (launchSpec{}) {
+		return &taskCommand{Cmd: exec.Command(command, args...)}
+	}
+	specJson, err := json.Marshal(spec)
+	check(err)
+	cmd := &taskCommand{
+		Cmd: exec.Command(launcherPath, append([]string{LAUNCH_COMMAND, string(specJson), command}, args...)...),
+	}
+	if spec.Isolation != nil {
+		isolateCommand(cmd.Cmd, spec.Isolation)
+		cmd.status, cmd.statusWrite, err = os.Pipe()
+		check(err)
+		cmd.ExtraFiles = []*os.File{cmd.statusWrite}
+	}
+	return cmd
+}
+
+// Let go of the worker's end of the pipe the init writes to, once the
+// command has started.
+func (cmd *taskCommand) started() {
+	if cmd.statusWrite != nil {
+		cmd.statusWrite.Close()
+	}
+}
+
+// Close the pipe the init writes to.
+func (cmd *taskCommand) close() {
+	if cmd.status != nil {
+		cmd.status.Close()
+		cmd.statusWrite.Close()
+	}
+}
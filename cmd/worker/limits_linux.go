@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"syscall"
+
+	"github.com/showalter/bdws/internal/data"
+)
+
+// RLIMIT_NPROC is missing from the syscall package
+const RLIMIT_NPROC = 6
+
+// Tell how the program of an isolated task ended, once its command has, if
+// its init got to say.
+func (cmd *taskCommand) programStatus() (syscall.WaitStatus, bool) {
+	if cmd.status == nil {
+		return 0, false
+	}
+	reply, err := ioutil.ReadAll(cmd.status)
+	if err != nil {
+		return 0, false
+	}
+	status, err := strconv.ParseUint(string(reply), 10, 32)
+	if err != nil {
+		return 0, false
+	}
+	return syscall.WaitStatus(status), true
+}
+
+// Tell which limit, if any, killed a task's program.
+func limitHit(env taskEnv, state *os.ProcessState, signal string) string {
+	if state == nil {
+		return ""
+	}
+
+	// The soft CPU limit sends SIGXCPU and the hard one, a second later, SIGKILL
+	cpu := state.UserTime() + state.SystemTime()
+	if signal == syscall.SIGXCPU.String() ||
+		(env.limits.CpuTime > 0 && signal == syscall.SIGKILL.String() && cpu >= env.limits.CpuTime) {
+		return data.LimitCpuTime
+	}
+
+	if env.cgroup != "" && state.ExitCode() != 0 {
+		if cgroupEvent(env.cgroup, "memory.events", "oom_kill") > 0 {
+			return data.LimitMemory
+		}
+		if cgroupEvent(env.cgroup, "pids.events", "max") > 0 {
+			return data.LimitProcesses
+		}
+	}
+	return ""
+}
+
+// Act as the launcher: join the cgroup, isolate the task, set the rlimits and
+// execute the program. Only returns if that fails, after exiting.
+func launch(args []string) {
+
+	// Privileges are dropped for the thread that executes the program
+	runtime.LockOSThread()
+
+	fail := func(err error) {
+		fmt.Fprintf(os.Stderr, "[Worker] Could not launch the task: %v\n", err)
+		os.Exit(NOT_RUN)
+	}
+	if len(args) < 2 {
+		fail(fmt.Errorf("nothing to launch"))
+	}
+
+	var spec launchSpec
+	if err := json.Unmarshal([]byte(args[0]), &spec); err != nil {
+		fail(err)
+	}
+
+	if spec.Cgroup != "" {
+		if err := writeCgroup(spec.Cgroup, "cgroup.procs", strconv.Itoa(os.Getpid())); err != nil {
+			fail(err)
+		}
+	}
+
+	// An isolated task's program runs under an init, which launches it again
+	// to set its limits. The cgroup is out of sight once the task is
+	// isolated, so the init is handed its process limit beforehand.
+	if spec.Isolation != nil {
+		syscall.CloseOnExec(STATUS_FD)
+		var pidsMax *os.File
+		if spec.Cgroup != "" {
+			pidsMax, _ = os.OpenFile(filepath.Join(spec.Cgroup, "pids.max"), os.O_RDWR, 0)
+		}
+		if err := isolate(spec.Isolation); err != nil {
+			fail(err)
+		}
+		fail(runInit(spec, pidsMax, args[1:]))
+	}
+
+	limits := []struct {
+		resource int
+		soft     uint64
+		hard     uint64
+	}{
+		{syscall.RLIMIT_CPU, spec.CpuTime, spec.CpuTime + 1},
+		{syscall.RLIMIT_AS, spec.AddressSpace, spec.AddressSpace},
+		{syscall.RLIMIT_NOFILE, spec.OpenFiles, spec.OpenFiles},
+		{RLIMIT_NPROC, spec.Processes, spec.Processes},
+	}
+	for _, limit := range limits {
+		if limit.soft == 0 {
+			continue
+		}
+		if err := syscall.Setrlimit(limit.resource, &syscall.Rlimit{Cur: limit.soft, Max: limit.hard}); err != nil {
+			fail(fmt.Errorf("setting limit %d: %v", limit.resource, err))
+		}
+	}
+
+	path, err := exec.LookPath(args[1])
+	if err != nil {
+		fail(err)
+	}
+	fail(syscall.Exec(path, args[1:], os.Environ()))
+}
@@ -0,0 +1,28 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// Only the init of an isolated task says how its program ended, and tasks
+// are only isolated on Linux.
+func (cmd *taskCommand) programStatus() (syscall.WaitStatus, bool) {
+	var status syscall.WaitStatus
+	return status, false
+}
+
+// Tasks are not limited here, so no limit kills them.
+func limitHit(env taskEnv, state *os.ProcessState, signal string) string {
+	return ""
+}
+
+// Act as the launcher, which cannot limit a task here.
+func launch(args []string) {
+	fmt.Fprintf(os.Stderr, "[Worker] Could not launch the task: resource limits are only supported on Linux\n")
+	os.Exit(NOT_RUN)
+}
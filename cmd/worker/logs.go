@@ -0,0 +1,204 @@
+// This file contains the streaming of tasks' output to the supervisor.
+//
+// As a task's pipes are read, what it outputs is split into lines, each
+// tagged with its stream and the time it was read. The lines are posted to
+// the supervisor every LOG_INTERVAL while the task runs and once more when
+// it exits, before its result is sent. Lines that pile up faster than the
+// supervisor takes them are dropped, and a line saying how many were dropped
+// takes their place; the task's result and the output it spills keep them,
+// up to the job's output limit.
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/showalter/bdws/internal/data"
+)
+
+// How often a running task's lines are sent to the supervisor
+const LOG_INTERVAL = 500 * time.Millisecond
+
+// Longest line sent; longer ones are split
+const MAX_LOG_LINE = 16 << 10
+
+// Lines that are sent without waiting for the interval
+const LOG_BATCH = 1000
+
+// Most lines waiting to be sent, in case the supervisor is slow
+const MAX_LOG_BACKLOG = 10000
+
+// The lines of a task's output waiting to be sent to the supervisor
+type taskLog struct {
+	jobId  int
+	taskId string
+
+	mutex    sync.Mutex
+	lines    []data.LogLine
+	partial  map[string][]byte // The unfinished last line of each stream
+	dropped  map[string]int    // Lines of each stream dropped since the last one sent
+	lost     int               // Lines dropped in all
+	disabled bool              // Set if the supervisor does not take lines
+
+	full    chan struct{} // Signalled when a batch of lines is waiting
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+// Start streaming the output of a task to the supervisor.
+func newTaskLog(jobId int, taskId string) *taskLog {
+	tl := &taskLog{
+		jobId:   jobId,
+		taskId:  taskId,
+		partial: make(map[string][]byte),
+		dropped: make(map[string]int),
+		full:    make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go tl.sendEvery(LOG_INTERVAL)
+	return tl
+}
+
+// Add output read from one of a task's streams. A task without a log, like
+// the one that checks isolation, is not streamed.
+func (tl *taskLog) write(stream string, output []byte) {
+	if tl == nil {
+		return
+	}
+	tl.mutex.Lock()
+	defer tl.mutex.Unlock()
+
+	now := time.Now()
+	text := append(tl.partial[stream], output...)
+	for {
+		end := bytes.IndexByte(text, '\n')
+		next := end + 1
+		if end < 0 || end > MAX_LOG_LINE {
+			if len(text) < MAX_LOG_LINE {
+				break
+			}
+			end, next = MAX_LOG_LINE, MAX_LOG_LINE
+		}
+		tl.add(data.LogLine{Time: now, Stream: stream, Text: string(text[:end])})
+		text = text[next:]
+	}
+	tl.partial[stream] = append([]byte(nil), text...)
+}
+
+// Queue a line to be sent, after a line saying how many lines of its stream
+// were dropped before it, if any were. The caller holds the mutex.
+func (tl *taskLog) add(line data.LogLine) {
+	if len(tl.lines)+1 >= MAX_LOG_BACKLOG {
+		tl.dropped[line.Stream]++
+		tl.lost++
+		return
+	}
+	tl.addDropped(line.Time, line.Stream)
+	tl.lines = append(tl.lines, line)
+	if len(tl.lines) >= LOG_BATCH {
+		select {
+		case tl.full <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Queue the line saying how many lines of a stream were dropped, if any
+// were. The caller holds the mutex.
+func (tl *taskLog) addDropped(now time.Time, stream string) {
+	if n := tl.dropped[stream]; n > 0 {
+		text := fmt.Sprintf("[Worker] %d lines were dropped here because the supervisor could not keep up", n)
+		tl.lines = append(tl.lines, data.LogLine{Time: now, Stream: stream, Text: text})
+		tl.dropped[stream] = 0
+	}
+}
+
+// Send the lines of a running task every interval, or as soon as a batch is
+// waiting, until the log is closed.
+func (tl *taskLog) sendEvery(interval time.Duration) {
+	defer close(tl.stopped)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			tl.send()
+		case <-tl.full:
+			tl.send()
+		case <-tl.stop:
+			return
+		}
+	}
+}
+
+// Send what is left of a task's output once its pipes are closed.
+func (tl *taskLog) close() {
+	if tl == nil {
+		return
+	}
+	close(tl.stop)
+	<-tl.stopped
+
+	tl.mutex.Lock()
+	now := time.Now()
+	for _, stream := range []string{data.StreamStdout, data.StreamStderr} {
+		if len(tl.partial[stream]) > 0 {
+			tl.add(data.LogLine{Time: now, Stream: stream, Text: string(tl.partial[stream])})
+			tl.partial[stream] = nil
+		}
+
+		// Say so even if the backlog is still full
+		tl.addDropped(now, stream)
+	}
+	tl.mutex.Unlock()
+
+	tl.send()
+	if tl.lost > 0 {
+		fmt.Printf("[Worker] Dropped %d lines of task %s that could not be sent in time\n", tl.lost, tl.taskId)
+	}
+}
+
+// Post the lines waiting to be sent to the supervisor.
+func (tl *taskLog) send() {
+	tl.mutex.Lock()
+	lines := tl.lines
+	tl.lines = nil
+	disabled := tl.disabled
+	tl.mutex.Unlock()
+
+	if len(lines) == 0 || disabled {
+		return
+	}
+
+	body, err := data.LogLinesToJson(lines)
+	if err != nil {
+		fmt.Printf("[Worker] Could not encode the output of task %s: %v\n", tl.taskId, err)
+		return
+	}
+	target := fmt.Sprintf("%s/jobs/%d/logs/%s", supervisorAddress, tl.jobId, url.PathEscape(tl.taskId))
+	resp, err := http.Post(target, "application/json", bytes.NewReader(body))
+	if err != nil {
+		fmt.Printf("[Worker] Could not send the output of task %s: %v\n", tl.taskId, err)
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		reply, _ := ioutil.ReadAll(resp.Body)
+		fmt.Printf("[Worker] Supervisor did not take the output of task %s (%s): %s\n", tl.taskId, resp.Status, errorMessage(reply))
+
+		// The supervisor is too old to take lines, or forgot the job
+		if resp.StatusCode == http.StatusNotFound {
+			tl.mutex.Lock()
+			tl.disabled = true
+			tl.mutex.Unlock()
+		}
+	}
+}
@@ -4,20 +4,29 @@ package main
 // TODO: https://pkg.go.dev/github.com/pborman/ansi#Writer.Red
 import (
 	"bytes"
+	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
+	"time"
 
 	"github.com/showalter/bdws/internal/data"
 )
 
-type codeFunction func([]byte, string, *int, []string) []byte
+// Strategies run the file of a job at the path prepareTask() put it, in the
+// task's working directory and within its limits
+type codeFunction func(context.Context, taskEnv, string, *int, []string) data.TaskResult
 
 // Map various extension names to their code
 var extensionMap = map[string]codeFunction{
@@ -33,6 +42,21 @@ var extensionMap = map[string]codeFunction{
 }
 
 var workerDirectory string
+var workerHostname string // host:port the supervisor reaches this worker at
+
+// Exit code reported for a task whose program could not be started, as a shell would
+const NOT_RUN = 127
+
+// How long a task has to exit after SIGTERM before it is killed
+const KILL_GRACE = 5 * time.Second
+
+// Serializes writing files and compiling them, since tasks run concurrently
+var fileMutex = &sync.Mutex{}
+var compileMutex = &sync.Mutex{}
+
+// Running tasks by id, so the supervisor can have them killed
+var runningTasks = make(map[string]context.CancelFunc)
+var tasksMutex = &sync.Mutex{}
 
 func grabStats() data.Registration {
 	//read /proc/cpuinfo into a byte array
@@ -44,11 +68,16 @@ func grabStats() data.Registration {
 
 	s := data.Registration{
 		Cores:        get_cores(cpuinfo),
-		ModelName:    get_cpu_info(cpuinfo),
+		ModelName:    strings.TrimSpace(get_cpu_info(cpuinfo)),
 		CpuSpeed:     getSpeed(get_cpu_info(cpuinfo)),
 		MemAvailable: get_mem_info(memdata),
 	}
 
+	// Not every model name ends in its speed, so fall back on the current clock
+	if s.CpuSpeed == 0 {
+		s.CpuSpeed = get_cpu_mhz(cpuinfo) / 1000
+	}
+
 	//fmt.Printf("%+v\n\n", s)
 
 	return s
@@ -83,8 +112,12 @@ func get_mem_info(data []byte) int {
 	lines := strings.Split(string(data), "\n")
 	for _, line := range lines {
 		if strings.Contains(line, "MemAvailable") {
-			//split the line by ' ' and return the second element
-			str, err := strconv.Atoi(strings.Split(line, " ")[4])
+			//split the line on whitespace and return the second element
+			fields := strings.Fields(line)
+			if len(fields) < 2 {
+				return 0
+			}
+			str, err := strconv.Atoi(fields[1])
 			check(err)
 			return str
 		}
@@ -92,66 +125,197 @@ func get_mem_info(data []byte) int {
 	return 0
 }
 
+// read the one minute load average from /proc/loadavg
+func grabLoad() float64 {
+	loadavg, err := ioutil.ReadFile("/proc/loadavg")
+	if err != nil {
+		return 0
+	}
+
+	fields := strings.Fields(string(loadavg))
+	if len(fields) == 0 {
+		return 0
+	}
+
+	load, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return 0
+	}
+	return load
+}
+
+// read the currently available memory from /proc/meminfo
+func grabMemAvailable() int {
+	memdata, err := ioutil.ReadFile("/proc/meminfo")
+	if err != nil {
+		return 0
+	}
+	return get_mem_info(memdata)
+}
+
+// read the speed in GHz from the end of a model name such as "... @ 3.60GHz",
+// or 0 if the model name does not include it
 func getSpeed(model string) float64 {
 	speed := strings.Split(model, " ")[len(strings.Split(model, " "))-1]
+	if !strings.HasSuffix(speed, "GHz") {
+		return 0
+	}
 	//remove the last 3 characters from speed
 	speed = speed[:len(speed)-3]
 	//convert speed to a float
 	speedFloat, err := strconv.ParseFloat(speed, 64)
-	check(err)
+	if err != nil {
+		return 0
+	}
 	return speedFloat
 }
 
+//read the first line in data that contains the string "cpu MHz"
+func get_cpu_mhz(data []byte) float64 {
+	lines := strings.Split(string(data), "\n")
+	for _, line := range lines {
+		if strings.Contains(line, "cpu MHz") {
+			mhz, err := strconv.ParseFloat(strings.TrimSpace(strings.Split(line, ":")[1]), 64)
+			if err != nil {
+				return 0
+			}
+			return mhz
+		}
+	}
+	return 0
+}
+
 /**
- * Calls the given command and returns its stdout, stderr and exit code.
- * @param cmd
- * @return stdout, stderr, exit code
+ * Asks a task's process group to stop with SIGTERM, and kills it if the
+ * task's program has not exited after KILL_GRACE.
+ * @param pgid the process group, which is the program's pid
+ * @param exited closed once the program has exited
  **/
-func runWithErrorCode(cmd *exec.Cmd) ([]byte, []byte, int, error) {
-	stdout, _ := cmd.StdoutPipe()
-	stderr, _ := cmd.StderrPipe()
+func terminate(pgid int, exited <-chan struct{}) {
+	signalGroup(pgid, syscall.SIGTERM)
 
-	/* Start the command */
-	if err := cmd.Start(); err != nil {
-		return []byte(""), []byte(""), 0, err
+	select {
+	case <-exited:
+	case <-time.After(KILL_GRACE):
+		signalGroup(pgid, syscall.SIGKILL)
 	}
+}
+
+/**
+ * Calls the given command, keeping its stdout and stderr, and returns its
+ * exit code.
+ * The command runs in a process group of its own, which is terminated if
+ * ctx is cancelled before it exits, and ended once it has.
+ * @param ctx
+ * @param cmd
+ * @param stdout keeps what the command writes to stdout
+ * @param stderr keeps what the command writes to stderr
+ * @return exit code, the signal that ended the command if any,
+ *         the processes left behind that had to be reaped
+ **/
+func runWithErrorCode(ctx context.Context, cmd *taskCommand, stdout *streamOutput, stderr *streamOutput) (int, string, int, error) {
 
-	/* Read from the pipes before the command terminates */
-	text, e1 := ioutil.ReadAll(stdout)
-	if e1 != nil {
-		return []byte(""), []byte(""), 0, e1
+	/* The program gets the write ends of the pipes itself, so waiting for it
+	   does not wait for whatever else holds them */
+	stdoutPipe, stdoutWrite, err := os.Pipe()
+	if err != nil {
+		return 0, "", 0, err
+	}
+	defer stdoutPipe.Close()
+	stderrPipe, stderrWrite, err := os.Pipe()
+	if err != nil {
+		stdoutWrite.Close()
+		return 0, "", 0, err
 	}
+	defer stderrPipe.Close()
+	cmd.Stdout = stdoutWrite
+	cmd.Stderr = stderrWrite
 
-	errText, e2 := ioutil.ReadAll(stderr)
-	if e2 != nil {
-		return []byte(""), []byte(""), 0, e2
+	newGroup(cmd.Cmd)
+
+	/* Start the command */
+	if err := ctx.Err(); err != nil {
+		stdoutWrite.Close()
+		stderrWrite.Close()
+		return 0, "", 0, err
+	}
+	err = cmd.Start()
+	stdoutWrite.Close()
+	stderrWrite.Close()
+	cmd.started()
+	if err != nil {
+		return 0, "", 0, err
 	}
+	pgid := cmd.Process.Pid
+
+	/* Read from the pipes while the command runs */
+	stdoutRead := readPipe(stdoutPipe, stdout)
+	stderrRead := readPipe(stderrPipe, stderr)
+
+	/* Stop the command if the task is killed, cancelled or runs out of time */
+	exited := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			terminate(pgid, exited)
+		case <-exited:
+		}
+	}()
 
 	exitCode := 0
+	signal := ""
 
 	/* Wait for the command to terminate and check the error code */
-	if err := cmd.Wait(); err != nil {
+	err = cmd.Wait()
+	close(exited)
+	if status, ok := cmd.programStatus(); ok {
+		/* The init of an isolated task says how its program ended */
+		exitCode = status.ExitStatus()
+		if status.Signaled() {
+			signal = status.Signal().String()
+		}
+	} else if err != nil {
 		if exiterr, ok := err.(*exec.ExitError); ok {
 			if status, ok := exiterr.Sys().(syscall.WaitStatus); ok {
 				log.Printf("Exit Status: %d", status.ExitStatus())
 				exitCode = status.ExitStatus()
+				if status.Signaled() {
+					signal = status.Signal().String()
+				}
 			}
 		} else {
 			//fmt.Println("AAAAAA\n")
-			return []byte(""), []byte(""), 0, err
+			endGroup(pgid)
+			return 0, "", 0, err
 		}
 	}
 
-	return []byte(text), []byte(errText), exitCode, nil
+	/* End whatever the command left running, which also closes the pipes,
+	   unless something that left the group still holds them */
+	orphans := endGroup(pgid)
+	if orphans > 0 {
+		fmt.Printf("[Worker] Reaped %d processes left behind by '%s'\n", orphans, cmd.Path)
+	}
+	stopReading := time.AfterFunc(KILL_GRACE, func() {
+		stdoutPipe.Close()
+		stderrPipe.Close()
+	})
+	<-stdoutRead
+	<-stderrRead
+	stopReading.Stop()
+	stdout.finish()
+	stderr.finish()
+
+	return exitCode, signal, orphans, nil
 }
 
 // run the code given an extension
-func runCode(e string, code []byte, fn string, num *int, args []string) []byte {
+func runCode(ctx context.Context, e string, env taskEnv, fullName string, num *int, args []string) data.TaskResult {
 	f, found := extensionMap[e]
 	if found {
-		return f(code, fn, num, args)
+		return f(ctx, env, fullName, num, args)
 	} else {
-		return []byte("Error: Extension not found.")
+		return data.TaskResult{Stderr: "Error: Extension not found.", ExitCode: NOT_RUN}
 	}
 }
 
@@ -162,8 +326,8 @@ func check(e error) {
 	}
 }
 
-// Run a given command.
-func run(command string, args ...string) []byte {
+// Run a given command as part of a task and return what happened.
+func run(ctx context.Context, env taskEnv, command string, args ...string) data.TaskResult {
 
 	shell_cmd := command
 	for _, arg := range args {
@@ -174,23 +338,67 @@ func run(command string, args ...string) []byte {
 	fmt.Printf("[Worker] Running '%s'!\n", shell_cmd)
 
 	// cmd := exec.Command("bash", "-c", shell_cmd)
-	cmd := exec.Command(shell_cmd)
-
-	textOut, textErr, exitCode, err := runWithErrorCode(cmd)
-	fmt.Printf("[Worker] Stdout: '%s'\n", textOut)
-	fmt.Printf("[Worker] Stderr: '%s'\n", textErr)
+	cmd := limitedCommand(env, command, args...)
+	defer cmd.close()
+	cmd.Dir = env.dir
+
+	stdout := newStreamOutput(data.StreamStdout, env.limits.Output, env.log)
+	defer stdout.remove()
+	stderr := newStreamOutput(data.StreamStderr, env.limits.Output, env.log)
+	defer stderr.remove()
+
+	start := time.Now()
+	exitCode, signal, orphans, err := runWithErrorCode(ctx, cmd, stdout, stderr)
+	fmt.Printf("[Worker] Stdout: '%s'\n", stdout.inline.String())
+	fmt.Printf("[Worker] Stderr: '%s'\n", stderr.inline.String())
 	fmt.Printf("[Worker] Exit Code: %d\n", exitCode)
 
 	if err != nil {
-		return []byte(fmt.Sprintf("[Client] '%s' returned an error code of %d on worker %s!", command, exitCode, workerDirectory))
+		return data.TaskResult{
+			Stderr:   fmt.Sprintf("'%s' could not be run on worker %s: %v", command, workerDirectory, err),
+			ExitCode: NOT_RUN,
+			Start:    start,
+			End:      time.Now(),
+		}
 	}
 
-	if exitCode != 0 {
-		return []byte(fmt.Sprintf("[Client] Job exited with error code %d\n[Stdout]\n%s\n[Stderr]\n%s", exitCode, textOut, textErr))
-	} else {
-		return []byte(fmt.Sprintf("[Stdout]\n%s\n[Stderr]\n%s", textOut, textErr))
+	result := data.TaskResult{
+		Stdout:   stdout.inline.String(),
+		Stderr:   stderr.inline.String(),
+		ExitCode: exitCode,
+		Signal:   signal,
+		Limit:    limitHit(env, cmd.ProcessState, signal),
+		Orphans:  orphans,
+		Start:    start,
+		End:      time.Now(),
+	}
+
+	// The supervisor keeps what did not fit in the result
+	result.Spilled = uploadOutput(env, stdout, stderr)
+	for _, o := range []*streamOutput{stdout, stderr} {
+		if o.truncated {
+			result.Truncated = append(result.Truncated, o.stream)
+		}
+	}
+	return result
+
+}
+
+// Run a task's code, in a cgroup of its own if tasks get one.
+func runInCgroup(ctx context.Context, job data.Job, env taskEnv, fullName string, num *int, args []string) data.TaskResult {
+	if cgroupRoot != "" {
+		cgroup, err := newCgroup(job.TaskId, job.Limits)
+		if err != nil {
+			return data.TaskResult{
+				Stderr:   fmt.Sprintf("A cgroup for the task could not be made on worker %s: %v", workerHostname, err),
+				ExitCode: NOT_RUN,
+			}
+		}
+		defer removeCgroup(cgroup)
+		env.cgroup = cgroup
 	}
 
+	return runCode(ctx, job.Extension, env, fullName, num, args)
 }
 
 // Handle the submission of a new job.
@@ -199,16 +407,51 @@ func new_job(w http.ResponseWriter, req *http.Request) {
 
 	// Parse the HTTP request.
 	if err := req.ParseForm(); err != nil {
-		panic(err)
+		replyError(w, http.StatusBadRequest, err.Error())
+		return
 	}
 
-	// Put the bytes from the request into a file
-	buf := new(bytes.Buffer)
-	buf.ReadFrom(req.Body)
-	jobJson := buf.String()
+	if shuttingDown() {
+		replyError(w, http.StatusServiceUnavailable, "worker is shutting down")
+		return
+	}
+
+	// Decode the job in whatever encoding the supervisor chose
+	job, err := data.DecodeJob(req.Body, req.Header.Get("Content-Type"), req.Header.Get("Content-Encoding"))
+	var versionErr *data.VersionError
+	if errors.As(err, &versionErr) {
+		replyError(w, http.StatusUpgradeRequired, "job rejected: "+err.Error())
+		return
+	} else if errors.Is(err, data.ErrUnsupportedEncoding) {
+		replyError(w, http.StatusUnsupportedMediaType, err.Error())
+		return
+	} else if errors.Is(err, data.ErrJobTooLarge) {
+		replyError(w, http.StatusRequestEntityTooLarge, err.Error())
+		return
+	} else if err != nil {
+		replyError(w, http.StatusBadRequest, "invalid job: "+err.Error())
+		return
+	}
 
-	// Convert string json to job struct
-	job := data.JsonToJob([]byte(jobJson))
+	// The task is killed if the supervisor asks, the supervisor hangs up,
+	// or the task runs past its time limit. It can be killed from here on,
+	// even while its code is being fetched.
+	ctx, kill := context.WithCancel(req.Context())
+	defer kill()
+	trackTask(job.TaskId, kill)
+	defer untrackTask(job.TaskId)
+
+	// Get the code from the cache, or from the supervisor
+	if err := cacheCode(ctx, &job); err != nil {
+		// Only a worker that is shutting down answers 503, which the
+		// supervisor takes to mean it should stop sending it tasks
+		fmt.Printf("[Worker] Could not get the code of task %s: %v\n", job.TaskId, err)
+		replyError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+	if job.CodeHash != "" {
+		defer releaseCode(job.CodeHash)
+	}
 
 	var num *int = nil
 
@@ -217,247 +460,461 @@ func new_job(w http.ResponseWriter, req *http.Request) {
 	}
 
 	var args []string
-	if job.Args[0] != "NONE" {
+	if len(job.Args) > 0 && job.Args[0] != "NONE" {
 		args = job.Args
 	}
 
+	runCtx := ctx
+	if job.Timeout > 0 {
+		var cancel context.CancelFunc
+		runCtx, cancel = context.WithTimeout(ctx, job.Timeout)
+		defer cancel()
+	}
+
+	// The supervisor gives up on the task once its lease runs out, which
+	// leaves data.UploadTimeout past the time limit for handing over what
+	// the task output, however long the code took to fetch
+	leaseCtx := ctx
+	if job.Timeout > 0 {
+		var cancel context.CancelFunc
+		leaseCtx, cancel = context.WithTimeout(ctx, data.FetchTimeout+job.Timeout+data.UploadTimeout)
+		defer cancel()
+	}
+
 	fmt.Printf("Running '%s'\n", job.FileName)
-	// Run the code and get []byte output
-	output := runCode(job.Extension, job.Code, job.FileName, num, args)
+	// Run the code and say where the result came from
+	var result data.TaskResult
+	workDir, fullName, err := prepareTask(job)
+	if err != nil {
+		result = data.TaskResult{
+			Stderr:   fmt.Sprintf("The code of '%s' could not be set up on worker %s: %v", job.FileName, workerHostname, err),
+			ExitCode: NOT_RUN,
+		}
+	} else {
+		env := taskEnv{
+			jobId:  job.Id,
+			taskId: job.TaskId,
+			dir:    workDir,
+			limits: job.Limits,
+			log:    newTaskLog(job.Id, job.TaskId),
+			lease:  leaseCtx,
+		}
+		if job.CodeHash != "" && job.Bundle == "" {
+			// A single file is run from the code directory
+			env.code = filepath.Dir(fullName)
+		}
+		result = runInCgroup(runCtx, job, env, fullName, num, args)
+		env.log.close()
+
+		// A worker that is shutting down does not answer, so the supervisor
+		// runs the task again elsewhere
+		if shuttingDown() {
+			retireDir(workDir, true)
+			panic(http.ErrAbortHandler)
+		}
+
+		// Hand the files the task output to the supervisor, then remove the
+		// working directory or keep it for a while
+		result.Artifacts = uploadArtifacts(leaseCtx, job, workDir, &result)
+		retireDir(workDir, result.ExitCode != 0 || result.Signal != "" || runCtx.Err() != nil)
+	}
+	result.JobId = job.Id
+	result.TaskId = job.TaskId
+	result.Parameterized = num != nil
+	result.Parameter = job.ParameterStart
+	result.Attempt = job.Attempt
+	result.Worker = workerHostname
 
 	// Send a response back.
-	w.Write(output)
+	w.Header().Set("Content-Type", "application/json")
+	if runCtx.Err() == context.DeadlineExceeded {
+		fmt.Printf("[Worker] Task %s ran past its limit of %v\n", job.TaskId, job.Timeout)
+		w.WriteHeader(http.StatusGatewayTimeout)
+	}
+	reply, err := data.TaskResultToJson(result)
+	if err != nil {
+		replyError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.Write(reply)
 	fmt.Printf("Sent response back!\n")
 }
 
+// Answer a request that could not be handled with a json error body.
+func replyError(w http.ResponseWriter, code int, message string) {
+	reply, err := data.ErrorToJson(data.Error{Error: message})
+	if err != nil {
+		http.Error(w, message, code)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(reply)
+}
+
+// Get the message out of an error reply.
+func errorMessage(reply []byte) string {
+	if e, err := data.JsonToError(reply); err == nil && e.Error != "" {
+		return e.Error
+	}
+	return strings.TrimSpace(string(reply))
+}
+
+// Remember how to kill a running task.
+func trackTask(id string, kill context.CancelFunc) {
+	tasksMutex.Lock()
+	defer tasksMutex.Unlock()
+	runningTasks[id] = kill
+}
+
+// Forget a task that finished.
+func untrackTask(id string) {
+	tasksMutex.Lock()
+	defer tasksMutex.Unlock()
+	delete(runningTasks, id)
+}
+
+// Handle a request from the supervisor to kill a task whose lease expired or
+// whose job was cancelled.
+func kill_task(w http.ResponseWriter, req *http.Request) {
+	buf := new(bytes.Buffer)
+	buf.ReadFrom(req.Body)
+	id := buf.String()
+
+	tasksMutex.Lock()
+	kill, found := runningTasks[id]
+	tasksMutex.Unlock()
+
+	if !found {
+		replyError(w, http.StatusNotFound, "no such task")
+		return
+	}
+
+	fmt.Printf("[Worker] Killing task %s\n", id)
+	kill()
+}
+
 // The entry point of the program.
 func main() {
 
+	// The worker starts itself to launch each task within its limits
+	if len(os.Args) > 1 && os.Args[1] == LAUNCH_COMMAND {
+		launch(os.Args[2:])
+	}
+
+	// Optional flags
+	flag.DurationVar(&keepSucceeded, "keep-succeeded", 0, "How long the working directory of a task that succeeded is kept\nExample: -keep-succeeded 1h (default: removed right away)")
+	flag.DurationVar(&keepFailed, "keep-failed", 24*time.Hour, "How long the working directory of a task that failed is kept, 0 to remove it right away")
+	cgroupPtr := flag.String("cgroup", "", "A writable cgroup v2 directory to run every task in a cgroup of its own under, which enforces memory and process limits\nExample: -cgroup /sys/fs/cgroup/user.slice/user-1000.slice/user@1000.service/bdws")
+	flag.BoolVar(&isolateTasks, "isolate", false, "Run every task in user, mount, PID and network namespaces of its own, which only see the system directories, the task's working directory and code, and a private /tmp")
+	flag.BoolVar(&shareNetwork, "share-network", false, "Let isolated tasks use the worker's network")
+	quotaPtr := flag.Int64("disk-quota", 0, "MB the worker directory may use; kept working directories and then unused cached code are removed, oldest first, to stay under it (default: no limit)")
+	flag.Parse()
+	diskQuota = *quotaPtr << 20
+
 	// The command line arguments. args[1] is the supervisor address,
 	// args[2] is the port to run on
-	args := os.Args
+	args := append([]string{os.Args[0]}, flag.Args()...)
 
 	// If the right number of arguments weren't passed, ask for them.
 	if len(args) != 3 {
 		fmt.Println("Please pass the hostname of the supervisor and the outgoing port." +
 			"eg. http://stu.cs.jmu.edu:4001 4031")
+		fmt.Println("\tRun ./worker -h for more info on optional flags")
 		os.Exit(1)
 	}
 
+	// Make a directory for this worker, to avoid IO errors from workers writing and reading to
+	// the same file. Tasks run from inside it, so its path is made absolute.
+	workerDirectory = args[2]
+	if _, err := os.Stat(workerDirectory); os.IsNotExist(err) {
+		err = os.Mkdir(args[2], 0777)
+		check(err)
+	}
+	absDirectory, err := filepath.Abs(workerDirectory)
+	check(err)
+	workerDirectory = absDirectory
+	check(os.MkdirAll(filepath.Join(workerDirectory, CACHE_DIR), 0777))
+	check(os.MkdirAll(filepath.Join(workerDirectory, CODE_DIR), 0777))
+	check(os.MkdirAll(filepath.Join(workerDirectory, TASKS_DIR), 0777))
+
+	// Output spilled by tasks is uploaded as they finish, so any left is from
+	// a worker that did not
+	check(os.RemoveAll(filepath.Join(workerDirectory, SPILL_DIR)))
+	check(os.MkdirAll(filepath.Join(workerDirectory, SPILL_DIR), 0777))
+	supervisorAddress = args[1]
+
+	// Tasks are launched by this executable
+	launcherPath, err = os.Executable()
+	check(err)
+	if *cgroupPtr != "" {
+		if err := setupCgroup(*cgroupPtr); err != nil {
+			log.Fatalf("[Worker] Cannot run tasks in cgroups under %s: %v", *cgroupPtr, err)
+		}
+	}
+
+	if isolateTasks {
+		if err := checkIsolation(); err != nil {
+			log.Fatalf("[Worker] Cannot isolate tasks on this machine: %v", err)
+		}
+	}
+
+	// Reap what tasks leave behind, and end tasks when the worker stops
+	if err := becomeSubreaper(); err != nil {
+		log.Fatalf("[Worker] Cannot become a subreaper: %v", err)
+	}
+	go stopOnSignal()
+
+	// Keep the worker directory tidy
+	go janitor()
+
+	// Start listening before registering so the supervisor never dispatches
+	// a task to a port that is not open yet.
+	listener, err := net.Listen("tcp", ":"+args[2])
+	check(err)
+
 	/* Send the stats about this worker to the supervisor for registration */
+	hostname, err := os.Hostname()
+	check(err)
+
 	reg := grabStats()
-	resp, err := http.Post(args[1]+"/register", "text/plain", bytes.NewReader(data.RegistrationToJson(reg)))
+	reg.Hostname = hostname + ":" + args[2]
+	reg.Encodings = data.Encodings
+	workerHostname = reg.Hostname
+	self := register(args[1], reg)
+
+	// Keep telling the supervisor this worker is alive
+	go heartbeat(args[1], reg, self)
+
+	// If there is a request for /newjob,
+	// the new_job routine will handle it.
+	http.HandleFunc("/newjob", new_job)
+	http.HandleFunc("/kill", kill_task)
+
+	// Serve on the port.
+	log.Fatal(http.Serve(listener, nil))
+}
+
+// Register this worker with the supervisor and return what the supervisor
+// thinks the worker is.
+func register(supervisor string, reg data.Registration) data.Worker {
+	regJson, err := data.RegistrationToJson(reg)
+	check(err)
+
+	resp, err := http.Post(supervisor+"/register", "text/plain", bytes.NewReader(regJson))
 	if err != nil {
 		panic(err)
 	}
 
 	buf := new(bytes.Buffer)
 	buf.ReadFrom(resp.Body)
+	resp.Body.Close()
 
-	// This gives what the supervisor thinks the worker is, which is useful for debugging.
-	_ = data.JsonToWorker(buf.Bytes())
+	if resp.StatusCode != http.StatusOK {
+		log.Fatalf("[Worker] Supervisor refused to register this worker (%s): %s", resp.Status, errorMessage(buf.Bytes()))
+	}
 
-	// Make a directory for this worker, to avoid IO errors from workers writing and reading to
-	// the same file.
-	workerDirectory = args[2]
-	if _, err = os.Stat(workerDirectory); os.IsNotExist(err) {
-		err = os.Mkdir(args[2], 0777)
-		check(err)
+	self, err := data.JsonToWorker(buf.Bytes())
+	if err != nil {
+		log.Fatalf("[Worker] Could not read the supervisor's registration reply: %v", err)
 	}
+	fmt.Printf("[Worker] Registered as worker %d\n", self.Id)
+	return self
+}
 
-	// If there is a request for /newjob,
-	// the new_job routine will handle it.
-	http.HandleFunc("/newjob", new_job)
+// Periodically send the supervisor this worker's load. If the supervisor no
+// longer knows about this worker (it was evicted or the supervisor restarted),
+// register again.
+func heartbeat(supervisor string, reg data.Registration, self data.Worker) {
+	for range time.Tick(data.HeartbeatInterval) {
+		hb := data.Heartbeat{
+			WorkerId:     self.Id,
+			Hostname:     reg.Hostname,
+			Load:         grabLoad(),
+			MemAvailable: grabMemAvailable(),
+		}
+
+		hbJson, err := data.HeartbeatToJson(hb)
+		check(err)
 
-	// Listen on a port.
-	log.Fatal(http.ListenAndServe(":"+args[2], nil))
+		resp, err := http.Post(supervisor+"/heartbeat", "text/plain", bytes.NewReader(hbJson))
+		if err != nil {
+			log.Printf("[Worker] Heartbeat failed: %v", err)
+			continue
+		}
+		reply, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode == http.StatusUpgradeRequired {
+			log.Fatalf("[Worker] Supervisor no longer accepts this worker: %s", errorMessage(reply))
+		} else if resp.StatusCode == http.StatusNotFound {
+			fmt.Println("[Worker] Supervisor forgot this worker, registering again")
+			reg.MemAvailable = hb.MemAvailable
+			self = register(supervisor, reg)
+		}
+	}
 }
 
 /* Code Strategies */
 
-// create a tmp file with given name and write to it
-func createFile(name string, code []byte) {
+// Write a file under its final name. Tasks run concurrently, so the file is
+// written to a temporary file and renamed into place; nobody ever sees it
+// half written.
+func createFile(name string, code []byte) error {
+	fileMutex.Lock()
+	defer fileMutex.Unlock()
+
 	// Create a temporary file
-	file, err := os.Create(name)
-	check(err)
+	file, err := ioutil.TempFile(workerDirectory, ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
 
 	// Write to file
 	_, err = file.Write(code)
-	check(err)
-	file.Sync()
+	if err == nil {
+		err = file.Sync()
+	}
 	file.Close()
+	if err != nil {
+		return err
+	}
+
+	if err := os.Chmod(file.Name(), 0700); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), name)
 }
 
 // Run a bash script / script
-func script(code []byte, fileName string, num *int, args []string) []byte {
-
-	var output []byte
-
-	fullName := workerDirectory + "/" + fileName
+func script(ctx context.Context, env taskEnv, fullName string, num *int, args []string) data.TaskResult {
 
-	// Create a temporary file
-	createFile(fullName, code)
-
-	// Make temp file executable.
-	check(os.Chmod(fullName, 0700))
+	var result data.TaskResult
 
-	// Execute temp file.
+	// Execute the file.
 	if num != nil {
 		args = append([]string{strconv.Itoa(*num)}, args...)
 	}
-	output = run(fullName, args...)
+	result = run(ctx, env, fullName, args...)
 
-	return output
+	return result
 }
 
 // Run a .class file
-func javaClass(code []byte, fileName string, num *int, args []string) []byte {
-
-	var output []byte
+func javaClass(ctx context.Context, env taskEnv, fullName string, num *int, args []string) data.TaskResult {
 
-	fullName := workerDirectory + "/" + fileName
+	var result data.TaskResult
 
-	// Create temporary file
-	createFile(fullName, code)
-
-	// Execute temp file.
+	// Execute the class.
 	if num != nil {
 		args = append([]string{strconv.Itoa(*num)}, args...)
 	}
 
-	args = append([]string{"-cp", workerDirectory, strings.Split(fileName, ".")[0]}, args...)
-	output = run("java", args...)
+	// The class is found from the directory it is in
+	className := strings.Split(filepath.Base(fullName), ".")[0]
+	args = append([]string{"-cp", filepath.Dir(fullName), className}, args...)
+	result = run(ctx, env, "java", args...)
 
-	return output
+	return result
 }
 
 // Run a .java file
-func javaFile(code []byte, fileName string, num *int, args []string) []byte {
-
-	fullName := workerDirectory + "/" + fileName
-
-	// Create temporary java file
-	className := strings.Split(fileName, ".")[0] + ".class"
-
-	_, err := os.Stat(fullName)
-	if os.IsNotExist(err) {
-		createFile(fullName, code)
-
-		// compile java file
-		run("javac", fullName)
-
-	} else {
-		existingCode, err := ioutil.ReadFile(fullName)
-		check(err)
-
-		if !bytes.Equal(existingCode, code) {
-			createFile(fullName, code)
-
-			// compile java file
-			run("javac", fullName)
+func javaFile(ctx context.Context, env taskEnv, fullName string, num *int, args []string) data.TaskResult {
+
+	dir := filepath.Dir(fullName)
+	className := strings.Split(filepath.Base(fullName), ".")[0] + ".class"
+
+	// A single file is kept in a directory named after the hash of its
+	// source, so a class compiled there before is from the same source. Only
+	// one task compiles at a time. Other classes of a bundle are compiled
+	// from next to the entrypoint as they are needed.
+	compileMutex.Lock()
+	if _, err := os.Stat(dir + "/" + className); err != nil {
+		compileEnv := env
+		compileEnv.writeCode = true
+		result := run(ctx, compileEnv, "javac", "-d", dir, "-sourcepath", dir, fullName)
+		if result.ExitCode != 0 {
+			compileMutex.Unlock()
+			return result
 		}
 	}
-
-	// get []byte code from class file
-	classCode, err := ioutil.ReadFile(workerDirectory + "/" + className)
-	if err != nil {
-		panic(err)
-	}
+	compileMutex.Unlock()
 
 	// Return output
-	return (javaClass(classCode, className, num, args))
+	return (javaClass(ctx, env, dir+"/"+className, num, args))
 }
 
 // Run a jar file
-func jarFile(code []byte, fileName string, num *int, args []string) []byte {
-
-	var output []byte
+func jarFile(ctx context.Context, env taskEnv, fullName string, num *int, args []string) data.TaskResult {
 
-	fullName := workerDirectory + "/" + fileName
-
-	// Create temporary file
-	createFile(fullName, code)
-
-	// Execute temp file.
+	var result data.TaskResult
 
+	// Execute the jar.
 	if num != nil {
 		args = append([]string{strconv.Itoa(*num)}, args...)
 	}
 
 	args = append([]string{"-jar", fullName}, args...)
-	output = run("java", args...)
+	result = run(ctx, env, "java", args...)
 
-	return output
+	return result
 }
 
 // Run a python script
-func pythonScript(code []byte, fileName string, num *int, args []string) []byte {
-
-	var output []byte
+func pythonScript(ctx context.Context, env taskEnv, fullName string, num *int, args []string) data.TaskResult {
 
-	fullName := workerDirectory + "/" + fileName
+	var result data.TaskResult
 
-	// Create temporary file
-	createFile(fullName, code)
-
-	// Execute temp script.
+	// Execute the script.
 	if num != nil {
 		args = append([]string{strconv.Itoa(*num)}, args...)
 	}
 	args = append([]string{fullName}, args...)
-	output = run("python3", args...)
+	result = run(ctx, env, "python3", args...)
 
-	return output
+	return result
 }
 
-func rubyScript(code []byte, fileName string, num *int, args []string) []byte {
-
-	var output []byte
-
-	fullName := workerDirectory + "/" + fileName
+func rubyScript(ctx context.Context, env taskEnv, fullName string, num *int, args []string) data.TaskResult {
 
-	// Create temporary file
-	createFile(fullName, code)
+	var result data.TaskResult
 
-	// Execute temp script.
+	// Execute the script.
 	if num != nil {
 		args = append([]string{strconv.Itoa(*num)}, args...)
 	}
 	args = append([]string{fullName}, args...)
-	output = run("rb", args...)
+	result = run(ctx, env, "rb", args...)
 
-	return output
+	return result
 }
 
-func perlScript(code []byte, fileName string, num *int, args []string) []byte {
-
-	var output []byte
-
-	fullName := workerDirectory + "/" + fileName
+func perlScript(ctx context.Context, env taskEnv, fullName string, num *int, args []string) data.TaskResult {
 
-	// Create temporary file
-	createFile(fullName, code)
+	var result data.TaskResult
 
-	// Execute temp script.
+	// Execute the script.
 	if num != nil {
 		args = append([]string{strconv.Itoa(*num)}, args...)
 	}
 	args = append([]string{fullName}, args...)
-	output = run("perl", args...)
+	result = run(ctx, env, "perl", args...)
 
-	return output
+	return result
 }
 
 // Run a system program
-func system_program(code []byte, fileName string, num *int, args []string) []byte {
+func system_program(ctx context.Context, env taskEnv, fullName string, num *int, args []string) data.TaskResult {
 
-	var output []byte
+	var result data.TaskResult
 
 	if num != nil {
 		args = append([]string{strconv.Itoa(*num)}, args...)
 	}
 
-	output = run(fileName, args...)
+	result = run(ctx, env, fullName, args...)
 
-	return output
+	return result
 }
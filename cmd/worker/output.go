@@ -0,0 +1,151 @@
+// This file contains the keeping of what tasks output.
+//
+// The start of each of a task's streams is kept in memory for its result.
+// Once a stream outgrows INLINE_OUTPUT, all of it is written to a file in the
+// worker directory's spill directory instead, which is uploaded to the
+// supervisor when the task's program exits and then removed, so a task that
+// prints a lot uses disk rather than memory. Output past the job's output
+// limit is read and dropped, and a line saying so ends what was kept.
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"github.com/showalter/bdws/internal/data"
+)
+
+// Where output too long for a result is written
+const SPILL_DIR = "spill"
+
+// Bytes of each stream a result holds
+const INLINE_OUTPUT = 64 << 10
+
+// What is kept of one of a task's streams
+type streamOutput struct {
+	stream    string
+	limit     int64    // Bytes kept, or 0 to keep everything
+	tl        *taskLog // Gets the kept output as it comes
+	inline    bytes.Buffer
+	spill     *os.File // All of the kept output, once it outgrows inline
+	size      int64    // Bytes kept
+	truncated bool
+	err       error // From writing to the spill file
+}
+
+// Start keeping the output of one of a task's streams.
+func newStreamOutput(stream string, limit int64, tl *taskLog) *streamOutput {
+	return &streamOutput{stream: stream, limit: limit, tl: tl}
+}
+
+// Take output read from the stream. All of it is taken, even past the
+// limit, so the task never blocks on a full pipe.
+func (o *streamOutput) Write(output []byte) (int, error) {
+	n := len(output)
+	if o.limit > 0 && o.size+int64(len(output)) > o.limit {
+		output = output[:o.limit-o.size]
+		o.truncated = true
+	}
+	if len(output) > 0 {
+		o.tl.write(o.stream, output)
+		o.keep(output)
+	}
+	return n, nil
+}
+
+// Keep output in memory while it fits, otherwise in the spill file.
+func (o *streamOutput) keep(output []byte) {
+	o.size += int64(len(output))
+	if o.spill == nil && o.inline.Len()+len(output) <= INLINE_OUTPUT {
+		o.inline.Write(output)
+		return
+	}
+
+	if o.spill == nil && o.err == nil {
+		o.spill, o.err = ioutil.TempFile(filepath.Join(workerDirectory, SPILL_DIR), o.stream+"-")
+		if o.err == nil {
+			_, o.err = o.spill.Write(o.inline.Bytes())
+		}
+	}
+	if o.err == nil {
+		_, o.err = o.spill.Write(output)
+	}
+	if room := INLINE_OUTPUT - o.inline.Len(); room > 0 {
+		if room > len(output) {
+			room = len(output)
+		}
+		o.inline.Write(output[:room])
+	}
+}
+
+// End the output once the stream is closed, saying if it was cut off.
+func (o *streamOutput) finish() {
+	if o.truncated {
+		marker := []byte(fmt.Sprintf("\n[Worker] Output cut off after %d bytes\n", o.limit))
+		o.tl.write(o.stream, marker)
+		o.keep(marker)
+	}
+}
+
+// Remove the spill file, if there is one.
+func (o *streamOutput) remove() {
+	if o.spill != nil {
+		o.spill.Close()
+		os.Remove(o.spill.Name())
+	}
+}
+
+// Upload the streams of a task that were spilled to the supervisor, and
+// return the ones it has.
+func uploadOutput(env taskEnv, outputs ...*streamOutput) []data.SpilledOutput {
+	var spilled []data.SpilledOutput
+	for _, o := range outputs {
+		if o.spill == nil {
+			continue
+		}
+		err := o.err
+		if err == nil {
+			err = uploadStream(env, o)
+		}
+		if err != nil {
+			fmt.Printf("[Worker] Could not keep the %s of task %s: %v\n", o.stream, env.taskId, err)
+			continue
+		}
+		spilled = append(spilled, data.SpilledOutput{Stream: o.stream, Size: o.size})
+	}
+	return spilled
+}
+
+// Upload the spill file of a stream.
+func uploadStream(env taskEnv, o *streamOutput) error {
+	file, err := os.Open(o.spill.Name())
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	target := fmt.Sprintf("%s/jobs/%d/output/%s/%s", supervisorAddress, env.jobId, url.PathEscape(env.taskId), o.stream)
+	req, err := http.NewRequestWithContext(env.lease, http.MethodPut, target, file)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = o.size
+	req.Header.Set("Content-Type", "application/octet-stream")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		reply, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("supervisor replied %s: %s", resp.Status, errorMessage(reply))
+	}
+	return nil
+}
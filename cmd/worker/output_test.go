@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/showalter/bdws/internal/data"
+)
+
+// Point the worker at a temporary directory with a spill directory.
+func spillDirectory(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "bdws-worker-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(dir, SPILL_DIR), 0755); err != nil {
+		t.Fatal(err)
+	}
+	workerDirectory = dir
+	return func() { os.RemoveAll(dir) }
+}
+
+// Output that is different at every offset, in uneven chunks
+func writeOutput(t *testing.T, o *streamOutput, size int) []byte {
+	output := make([]byte, size)
+	for i := range output {
+		output[i] = byte('a' + i%26 + i/26%7)
+	}
+	for written := 0; written < size; {
+		chunk := 5000 + written%3001
+		if written+chunk > size {
+			chunk = size - written
+		}
+		if n, _ := o.Write(output[written : written+chunk]); n != chunk {
+			t.Fatalf("took %d bytes of %d", n, chunk)
+		}
+		written += chunk
+	}
+	return output
+}
+
+func TestStreamOutputStaysInline(t *testing.T) {
+	defer spillDirectory(t)()
+
+	o := newStreamOutput(data.StreamStdout, 0, nil)
+	output := writeOutput(t, o, INLINE_OUTPUT)
+	o.finish()
+
+	if o.spill != nil {
+		t.Fatalf("output of %d bytes was spilled", INLINE_OUTPUT)
+	}
+	if !bytes.Equal(o.inline.Bytes(), output) {
+		t.Fatalf("kept %d bytes inline, want all %d", o.inline.Len(), len(output))
+	}
+}
+
+func TestStreamOutputSpills(t *testing.T) {
+	defer spillDirectory(t)()
+
+	o := newStreamOutput(data.StreamStdout, 0, nil)
+	output := writeOutput(t, o, 3*INLINE_OUTPUT+123)
+	o.finish()
+	defer o.remove()
+
+	if !bytes.Equal(o.inline.Bytes(), output[:INLINE_OUTPUT]) {
+		t.Errorf("kept %d bytes inline, want the first %d", o.inline.Len(), INLINE_OUTPUT)
+	}
+	if o.spill == nil || o.err != nil {
+		t.Fatalf("output was not spilled: %v", o.err)
+	}
+	spilled, err := ioutil.ReadFile(o.spill.Name())
+	if err != nil || !bytes.Equal(spilled, output) {
+		t.Fatalf("spilled %d bytes (%v), want all %d", len(spilled), err, len(output))
+	}
+	if o.size != int64(len(output)) || o.truncated {
+		t.Errorf("got size %d, truncated %v, want %d untruncated", o.size, o.truncated, len(output))
+	}
+
+	// The spill file is uploaded whole
+	var uploaded []byte
+	var uploadPath string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		uploadPath = r.URL.Path
+		uploaded, _ = ioutil.ReadAll(r.Body)
+	}))
+	defer server.Close()
+	supervisorAddress = server.URL
+
+	kept := uploadOutput(taskEnv{jobId: 3, taskId: "3.1.1", lease: context.Background()}, o)
+	if len(kept) != 1 || kept[0].Stream != data.StreamStdout || kept[0].Size != int64(len(output)) {
+		t.Errorf("got %+v, want all of stdout", kept)
+	}
+	if uploadPath != "/jobs/3/output/3.1.1/stdout" || !bytes.Equal(uploaded, output) {
+		t.Errorf("uploaded %d bytes to %s, want %d", len(uploaded), uploadPath, len(output))
+	}
+
+	o.remove()
+	if _, err := os.Stat(o.spill.Name()); !os.IsNotExist(err) {
+		t.Errorf("the spill file was not removed")
+	}
+}
+
+func TestStreamOutputLimit(t *testing.T) {
+	defer spillDirectory(t)()
+
+	const limit = 2*INLINE_OUTPUT + 7
+	o := newStreamOutput(data.StreamStderr, limit, nil)
+	output := writeOutput(t, o, 4*INLINE_OUTPUT)
+	o.finish()
+	defer o.remove()
+
+	if !o.truncated {
+		t.Fatal("output past the limit was not cut off")
+	}
+	if !bytes.Equal(o.inline.Bytes(), output[:INLINE_OUTPUT]) {
+		t.Errorf("kept %d bytes inline, want the first %d", o.inline.Len(), INLINE_OUTPUT)
+	}
+	spilled, err := ioutil.ReadFile(o.spill.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(spilled[:limit], output[:limit]) {
+		t.Errorf("the spill file does not start with the first %d bytes", limit)
+	}
+	marker := string(spilled[limit:])
+	if !strings.HasPrefix(marker, "\n[Worker] Output cut off after") || int64(len(spilled)) != o.size {
+		t.Errorf("got %q after the limit with size %d, want the marker", marker, o.size)
+	}
+}
@@ -0,0 +1,265 @@
+// Compact binary encoding of jobs
+package data
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+)
+
+// Content types a job can be sent as
+const (
+	ContentTypeJson   = "application/json"
+	ContentTypeBinary = "application/x-bdws-job"
+)
+
+// Job encodings that can be negotiated
+const (
+	EncodingJson       = "json"        // The job as json, with its code in base64
+	EncodingBinary     = "binary"      // A json header followed by the raw code
+	EncodingBinaryGzip = "binary+gzip" // The binary encoding, gzip compressed
+)
+
+// Every job encoding, most compact first
+var Encodings = []string{EncodingBinaryGzip, EncodingBinary, EncodingJson}
+
+// Largest header a binary job may have, to bound what a bad request allocates
+const maxHeaderSize = 64 << 20
+
+// Largest code a job may have
+const MaxCodeSize = 1 << 30
+
+// Most bytes a job is decoded from, before and after decompressing it. This
+// leaves room for the header and for the code growing by a third as base64
+// in json.
+const MaxJobSize = maxHeaderSize + (MaxCodeSize+2)/3*4
+
+// Returned when a job is sent with a content type or encoding this binary
+// does not understand
+var ErrUnsupportedEncoding = errors.New("unsupported job encoding")
+
+// Returned when a job is larger than MaxJobSize or its code than MaxCodeSize
+var ErrJobTooLarge = errors.New("job is too large")
+
+// A job encoded for an HTTP request
+type EncodedJob struct {
+	Body            io.Reader
+	ContentType     string
+	ContentEncoding string // "gzip" or empty
+}
+
+/**
+ * Returns whether an encoding is one of Encodings
+ */
+func ValidEncoding(encoding string) bool {
+	for _, e := range Encodings {
+		if e == encoding {
+			return true
+		}
+	}
+	return false
+}
+
+/**
+ * Compresses the code of a job for EncodingBinaryGzip. A job's code can be
+ * packed once and sent with every one of its tasks.
+ */
+func PackCode(code []byte) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	zw := gzip.NewWriter(buf)
+
+	// Write the code and flush the gzip member
+	if _, err := zw.Write(code); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+/**
+ * Encodes a job for sending.
+ *
+ * The binary encoding is the length of a json header (4 bytes, big endian),
+ * the header, which is the job without its code, the length of the code (8
+ * bytes, big endian) and the code itself. With gzip the header and the code
+ * are compressed separately; gzip streams can be concatenated, so packedCode
+ * from PackCode can be reused across tasks without compressing it again. If
+ * packedCode is nil the code is packed here.
+ */
+func EncodeJob(job Job, encoding string, packedCode []byte) (EncodedJob, error) {
+	switch encoding {
+	case EncodingJson:
+		b, err := JobToJson(job)
+		return EncodedJob{Body: bytes.NewReader(b), ContentType: ContentTypeJson}, err
+
+	case EncodingBinary, EncodingBinaryGzip:
+		code := job.Code
+		job.Code = nil
+
+		// Frame the header and the length of the code
+		header, err := JobToJson(job)
+		if err != nil {
+			return EncodedJob{}, err
+		}
+		frame := make([]byte, 4, 4+len(header)+8)
+		binary.BigEndian.PutUint32(frame, uint32(len(header)))
+		frame = append(frame, header...)
+		frame = append(frame, make([]byte, 8)...)
+		binary.BigEndian.PutUint64(frame[len(frame)-8:], uint64(len(code)))
+
+		if encoding == EncodingBinary {
+			body := io.MultiReader(bytes.NewReader(frame), bytes.NewReader(code))
+			return EncodedJob{Body: body, ContentType: ContentTypeBinary}, nil
+		}
+
+		// Compress the header and reuse the packed code if there is one
+		packedFrame, err := PackCode(frame)
+		if err != nil {
+			return EncodedJob{}, err
+		}
+		if packedCode == nil {
+			if packedCode, err = PackCode(code); err != nil {
+				return EncodedJob{}, err
+			}
+		}
+		body := io.MultiReader(bytes.NewReader(packedFrame), bytes.NewReader(packedCode))
+		return EncodedJob{Body: body, ContentType: ContentTypeBinary, ContentEncoding: "gzip"}, nil
+	}
+
+	return EncodedJob{}, fmt.Errorf("%w: %s", ErrUnsupportedEncoding, encoding)
+}
+
+/**
+ * Decodes a job sent with EncodeJob, or as plain json by an HTTP client
+ * that does not set a content type. Neither the body nor what it decompresses
+ * to may be larger than MaxJobSize, so a small body cannot make the decoder
+ * read without end.
+ */
+func DecodeJob(body io.Reader, contentType string, contentEncoding string) (Job, error) {
+	return decodeJob(body, contentType, contentEncoding, MaxJobSize)
+}
+
+/**
+ * Decodes a job of at most limit bytes
+ */
+func decodeJob(body io.Reader, contentType string, contentEncoding string, limit int64) (Job, error) {
+	body = &jobReader{body, limit}
+
+	switch contentEncoding {
+	case "", "identity":
+	case "gzip":
+		zr, err := gzip.NewReader(body)
+		if err != nil {
+			return Job{}, err
+		}
+		defer zr.Close()
+		body = &jobReader{zr, limit}
+	default:
+		return Job{}, fmt.Errorf("%w: content encoding %s", ErrUnsupportedEncoding, contentEncoding)
+	}
+
+	mediaType := ""
+	if contentType != "" {
+		var err error
+		if mediaType, _, err = mime.ParseMediaType(contentType); err != nil {
+			return Job{}, err
+		}
+	}
+
+	switch mediaType {
+	case "", ContentTypeJson, "text/plain":
+		b, err := ioutil.ReadAll(body)
+		if err != nil {
+			return Job{}, err
+		}
+		job, err := JsonToJob(b)
+		if err == nil && len(job.Code) > MaxCodeSize {
+			return Job{}, fmt.Errorf("%w: code of %d bytes", ErrJobTooLarge, len(job.Code))
+		}
+		return job, err
+
+	case ContentTypeBinary:
+		return readBinaryJob(body)
+	}
+
+	return Job{}, fmt.Errorf("%w: content type %s", ErrUnsupportedEncoding, contentType)
+}
+
+/**
+ * Reads a job in the binary encoding
+ */
+func readBinaryJob(body io.Reader) (Job, error) {
+	var size [8]byte
+
+	// Read the header
+	if _, err := io.ReadFull(body, size[:4]); err != nil {
+		return Job{}, fmt.Errorf("reading header length: %w", err)
+	}
+	headerLen := binary.BigEndian.Uint32(size[:4])
+	if headerLen > maxHeaderSize {
+		return Job{}, fmt.Errorf("header of %d bytes is too large", headerLen)
+	}
+	header := make([]byte, headerLen)
+	if _, err := io.ReadFull(body, header); err != nil {
+		return Job{}, fmt.Errorf("reading header: %w", err)
+	}
+
+	job, err := JsonToJob(header)
+	if err != nil {
+		return job, err
+	}
+
+	// Read the code without trusting its length for the allocation
+	if _, err := io.ReadFull(body, size[:]); err != nil {
+		return Job{}, fmt.Errorf("reading code length: %w", err)
+	}
+	codeLen := binary.BigEndian.Uint64(size[:])
+	if codeLen > MaxCodeSize {
+		return Job{}, fmt.Errorf("%w: code of %d bytes", ErrJobTooLarge, codeLen)
+	}
+	code, err := ioutil.ReadAll(io.LimitReader(body, int64(codeLen)))
+	if err != nil {
+		return Job{}, fmt.Errorf("reading code: %w", err)
+	}
+	if uint64(len(code)) != codeLen {
+		return Job{}, fmt.Errorf("code is %d bytes, expected %d", len(code), codeLen)
+	}
+
+	if codeLen > 0 {
+		job.Code = code
+	}
+	return job, nil
+}
+
+// Reads at most a job's worth of bytes, failing with ErrJobTooLarge once
+// there are more
+type jobReader struct {
+	r    io.Reader
+	left int64
+}
+
+func (j *jobReader) Read(p []byte) (int, error) {
+	if j.left <= 0 {
+		// The end of the job has to be right here
+		var b [1]byte
+		n, err := j.r.Read(b[:])
+		if n > 0 {
+			return 0, ErrJobTooLarge
+		}
+		return 0, err
+	}
+
+	if int64(len(p)) > j.left {
+		p = p[:j.left]
+	}
+	n, err := j.r.Read(p)
+	j.left -= int64(n)
+	return n, err
+}
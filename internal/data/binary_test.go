@@ -0,0 +1,254 @@
+package data
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// A job like one task of a parameter sweep over a large jar
+func sweepJob(codeSize int) Job {
+	r := rand.New(rand.NewSource(1))
+
+	// Bytes from a small alphabet compress about as well as class files do
+	code := make([]byte, codeSize)
+	for i := range code {
+		code[i] = "abcdefghijklmnop"[r.Intn(16)]
+	}
+
+	return Job{
+		Id:             7,
+		Time:           time.Unix(1650000000, 0),
+		Machines:       1,
+		ParameterStart: 42,
+		ParameterEnd:   43,
+		FileName:       "sweep.jar",
+		Extension:      "jar",
+		Code:           code,
+		Args:           []string{"-v"},
+		Nruns:          1,
+		TaskId:         "7.41.1",
+		Attempt:        1,
+	}
+}
+
+func decodeEncoded(t testing.TB, encoded EncodedJob) Job {
+	job, err := DecodeJob(encoded.Body, encoded.ContentType, encoded.ContentEncoding)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return job
+}
+
+func TestEncodeJobRoundTrip(t *testing.T) {
+	want := sweepJob(1 << 16)
+
+	for _, encoding := range Encodings {
+		encoded, err := EncodeJob(want, encoding, nil)
+		if err != nil {
+			t.Fatalf("%s: %v", encoding, err)
+		}
+		got := decodeEncoded(t, encoded)
+
+		if !bytes.Equal(got.Code, want.Code) || got.TaskId != want.TaskId ||
+			got.ParameterStart != want.ParameterStart || !got.Time.Equal(want.Time) {
+			t.Errorf("%s: decoded job differs from the one encoded", encoding)
+		}
+	}
+}
+
+func TestEncodeJobReusesPackedCode(t *testing.T) {
+	job := sweepJob(1 << 16)
+	packed, err := PackCode(job.Code)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, parameter := range []int{1, 2} {
+		job.ParameterStart = parameter
+		encoded, err := EncodeJob(job, EncodingBinaryGzip, packed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := decodeEncoded(t, encoded)
+		if got.ParameterStart != parameter || !bytes.Equal(got.Code, job.Code) {
+			t.Errorf("parameter %d: decoded job differs from the one encoded", parameter)
+		}
+	}
+}
+
+func TestDecodeJobRejectsBadInput(t *testing.T) {
+	_, err := DecodeJob(bytes.NewReader(nil), "application/x-unknown", "")
+	if !errors.Is(err, ErrUnsupportedEncoding) {
+		t.Errorf("unknown content type: got %v", err)
+	}
+
+	_, err = DecodeJob(bytes.NewReader(nil), ContentTypeJson, "br")
+	if !errors.Is(err, ErrUnsupportedEncoding) {
+		t.Errorf("unknown content encoding: got %v", err)
+	}
+
+	encoded, err := EncodeJob(sweepJob(1024), EncodingBinary, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(encoded.Body)
+	if _, err := DecodeJob(bytes.NewReader(body[:len(body)-1]), ContentTypeBinary, ""); err == nil {
+		t.Error("truncated binary job decoded without an error")
+	}
+}
+
+// A gzip stream of many zeros, which compresses to a thousandth of its size
+func zeros(t *testing.T, prefix []byte, size int) []byte {
+	buf := new(bytes.Buffer)
+	zw := gzip.NewWriter(buf)
+	zw.Write(prefix)
+	zw.Write(make([]byte, size))
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestDecodeJobLimitsSize(t *testing.T) {
+	const limit = 1 << 20
+
+	encode := func(job Job, encoding string) []byte {
+		encoded, err := EncodeJob(job, encoding, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(encoded.Body)
+		return body
+	}
+
+	// A binary frame that claims code of the given length
+	frame := func(codeLen uint64) []byte {
+		body := encode(Job{FileName: "bomb.sh"}, EncodingBinary)
+		binary.BigEndian.PutUint64(body[len(body)-8:], codeLen)
+		return body
+	}
+
+	small := sweepJob(limit / 4)
+	large := sweepJob(limit)
+	tests := []struct {
+		name        string
+		body        []byte
+		contentType string
+		encoding    string
+		tooLarge    bool
+	}{
+		{"json within the limit", encode(small, EncodingJson), ContentTypeJson, "", false},
+		{"binary within the limit", encode(small, EncodingBinary), ContentTypeBinary, "", false},
+		{"gzip within the limit", encode(small, EncodingBinaryGzip), ContentTypeBinary, "gzip", false},
+		{"json over the limit", encode(large, EncodingJson), ContentTypeJson, "", true},
+		{"binary over the limit", encode(large, EncodingBinary), ContentTypeBinary, "", true},
+		{"gzip over the limit", encode(large, EncodingBinaryGzip), ContentTypeBinary, "gzip", true},
+		{"gzip bomb as json", zeros(t, []byte(`{"Code": "`), 64*limit), ContentTypeJson, "gzip", true},
+		{"gzip bomb as code", zeros(t, frame(32*limit), 64*limit), ContentTypeBinary, "gzip", true},
+		{"zeros after the code are not read", zeros(t, frame(0), 64*limit), ContentTypeBinary, "gzip", false},
+	}
+
+	for _, test := range tests {
+		_, err := decodeJob(bytes.NewReader(test.body), test.contentType, test.encoding, limit)
+		if tooLarge := errors.Is(err, ErrJobTooLarge); tooLarge != test.tooLarge {
+			t.Errorf("%s: got %v, want too large %v", test.name, err, test.tooLarge)
+		} else if !test.tooLarge && err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		}
+	}
+
+	// Code longer than any job may have is refused before it is read
+	_, err := DecodeJob(bytes.NewReader(frame(MaxCodeSize+1)), ContentTypeBinary, "")
+	if !errors.Is(err, ErrJobTooLarge) {
+		t.Errorf("code of %d bytes: got %v", MaxCodeSize+1, err)
+	}
+}
+
+// The benchmarks encode and decode one task of a job with 8MB of code, as the
+// supervisor and a worker do for every task
+const benchCodeSize = 8 << 20
+
+func BenchmarkEncodeTaskJson(b *testing.B) {
+	job := sweepJob(benchCodeSize)
+	b.SetBytes(benchCodeSize)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := JobToJson(job); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func benchmarkEncodeTask(b *testing.B, encoding string, packed []byte) {
+	job := sweepJob(benchCodeSize)
+	b.SetBytes(benchCodeSize)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		encoded, err := EncodeJob(job, encoding, packed)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err := io.Copy(ioutil.Discard, encoded.Body); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkEncodeTaskBinary(b *testing.B) {
+	benchmarkEncodeTask(b, EncodingBinary, nil)
+}
+
+func BenchmarkEncodeTaskBinaryGzip(b *testing.B) {
+	benchmarkEncodeTask(b, EncodingBinaryGzip, nil)
+}
+
+// The supervisor packs a job's code once, so only the header is compressed
+// per task
+func BenchmarkEncodeTaskBinaryGzipPacked(b *testing.B) {
+	packed, err := PackCode(sweepJob(benchCodeSize).Code)
+	if err != nil {
+		b.Fatal(err)
+	}
+	benchmarkEncodeTask(b, EncodingBinaryGzip, packed)
+}
+
+func benchmarkDecodeTask(b *testing.B, encoding string) {
+	encoded, err := EncodeJob(sweepJob(benchCodeSize), encoding, nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(encoded.Body)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.SetBytes(benchCodeSize)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := DecodeJob(bytes.NewReader(body), encoded.ContentType, encoded.ContentEncoding); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(len(body)), "wire-bytes")
+}
+
+func BenchmarkDecodeTaskJson(b *testing.B) {
+	benchmarkDecodeTask(b, EncodingJson)
+}
+
+func BenchmarkDecodeTaskBinary(b *testing.B) {
+	benchmarkDecodeTask(b, EncodingBinary)
+}
+
+func BenchmarkDecodeTaskBinaryGzip(b *testing.B) {
+	benchmarkDecodeTask(b, EncodingBinaryGzip)
+}
@@ -0,0 +1,69 @@
+// Jobs whose code or output is several files
+package data
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// Archive formats a job's code can be bundled in. A job with a bundle runs
+// the file named by its FileName from inside the unpacked archive.
+const (
+	BundleTar     = "tar"
+	BundleTarGzip = "tar.gz"
+	BundleZip     = "zip"
+)
+
+/**
+ * Returns whether a bundle format is one workers can unpack. The empty
+ * format is a job with a single file.
+ */
+func ValidBundle(bundle string) bool {
+	switch bundle {
+	case "", BundleTar, BundleTarGzip, BundleZip:
+		return true
+	}
+	return false
+}
+
+/**
+ * Returns the bundle format of an archive from its file name, or "" if the
+ * name is not that of an archive
+ */
+func BundleFormat(name string) string {
+	switch {
+	case strings.HasSuffix(name, ".tar"):
+		return BundleTar
+	case strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"):
+		return BundleTarGzip
+	case strings.HasSuffix(name, ".zip"):
+		return BundleZip
+	}
+	return ""
+}
+
+/**
+ * Cleans the slash separated name of a file within a directory, such as a
+ * file of a bundle or an artifact, refusing names that would be outside it.
+ * The directory itself is ".".
+ */
+func RelativePath(name string) (string, error) {
+	clean := path.Clean(strings.ReplaceAll(name, "\\", "/"))
+	if path.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", fmt.Errorf("%s: path is outside the directory", name)
+	}
+	return clean, nil
+}
+
+/**
+ * Checks that an output pattern is a valid glob that only matches files
+ * within a task's working directory
+ */
+func CheckOutputPattern(pattern string) error {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return fmt.Errorf("%s: %v", pattern, err)
+	}
+	_, err := RelativePath(pattern)
+	return err
+}
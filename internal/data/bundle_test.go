@@ -0,0 +1,40 @@
+package data
+
+import "testing"
+
+func TestRelativePath(t *testing.T) {
+	tests := []struct {
+		name string
+		want string // "" if the name is refused
+	}{
+		{"main.py", "main.py"},
+		{"src/main.py", "src/main.py"},
+		{"./src//main.py", "src/main.py"},
+		{"src/../main.py", "main.py"},
+		{"src\\main.py", "src/main.py"},
+		{".", "."},
+		{"", "."},
+		{"..foo", "..foo"},
+		{"..", ""},
+		{"../main.py", ""},
+		{"src/../../main.py", ""},
+		{"..\\main.py", ""},
+		{"src\\..\\..\\main.py", ""},
+		{"/etc/passwd", ""},
+		{"\\etc\\passwd", ""},
+		{"/../main.py", ""},
+	}
+
+	for _, test := range tests {
+		got, err := RelativePath(test.name)
+		if test.want == "" {
+			if err == nil {
+				t.Errorf("RelativePath(%q) = %q, want it refused", test.name, got)
+			}
+			continue
+		}
+		if err != nil || got != test.want {
+			t.Errorf("RelativePath(%q) = %q, %v, want %q", test.name, got, err, test.want)
+		}
+	}
+}
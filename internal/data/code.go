@@ -0,0 +1,28 @@
+// Content addressing of job code
+package data
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+/**
+ * Returns the address of a job's code: its sha256 digest in hex. Workers
+ * cache code under this name and the supervisor serves it at /code/<hash>.
+ */
+func HashCode(code []byte) string {
+	sum := sha256.Sum256(code)
+	return hex.EncodeToString(sum[:])
+}
+
+/**
+ * Returns whether a string looks like a hash from HashCode, so it is safe to
+ * use as a file name
+ */
+func ValidCodeHash(hash string) bool {
+	if len(hash) != 2*sha256.Size {
+		return false
+	}
+	_, err := hex.DecodeString(hash)
+	return err == nil
+}
@@ -0,0 +1,80 @@
+package data
+
+import (
+	"encoding/json"
+	"time"
+)
+
+/** The streams of a task's output */
+const (
+	StreamStdout = "stdout"
+	StreamStderr = "stderr"
+)
+
+/**
+ * A line a task output, sent by the worker while the task runs. The
+ * supervisor keeps a job's lines in the order they arrive and serves them as
+ * json, one line per line.
+ */
+type LogLine struct {
+	Version int       // ProtocolVersion of the sender
+	TaskId  string    // Set by the supervisor from the task the worker names
+	Time    time.Time // When the worker read the line
+	Stream  string    // StreamStdout or StreamStderr
+	Text    string    // Without its newline
+}
+
+/**
+ * Tells whether a stream is one a task outputs
+ */
+func ValidStream(stream string) bool {
+	return stream == StreamStdout || stream == StreamStderr
+}
+
+/**
+ * Saves a list of LogLines into json
+ */
+func LogLinesToJson(lines []LogLine) ([]byte, error) {
+
+	// Stamp a copy of every line with this binary's protocol version
+	stamped := make([]LogLine, len(lines))
+	for i, line := range lines {
+		line.Version = ProtocolVersion
+		stamped[i] = line
+	}
+	return json.Marshal(stamped)
+}
+
+/**
+ * Converts a []byte of json into a list of LogLines
+ */
+func JsonToLogLines(b []byte) ([]LogLine, error) {
+	var lines []LogLine
+	err := json.Unmarshal(b, &lines)
+	for _, line := range lines {
+		if err == nil {
+			err = checkVersion(line.Version)
+		}
+	}
+	return lines, err
+}
+
+/**
+ * Saves a LogLine into json, as the supervisor serves them
+ */
+func LogLineToJson(line LogLine) ([]byte, error) {
+	line.Version = ProtocolVersion
+	return json.Marshal(line)
+}
+
+/**
+ * Converts a []byte of json into a LogLine, as the supervisor serves them
+ */
+func JsonToLogLine(b []byte) (LogLine, error) {
+	var line LogLine
+	err := json.Unmarshal(b, &line)
+	if err == nil {
+		err = checkVersion(line.Version)
+	}
+	return line, err
+}
@@ -0,0 +1,47 @@
+// Versioning of the messages exchanged by clients, supervisors and workers
+package data
+
+import "fmt"
+
+// The version of the protocol this binary speaks. Every message is stamped
+// with it when it is encoded, and decoding a message from a binary that
+// speaks a version outside MinProtocolVersion..ProtocolVersion fails.
+//
+// Version 2 dispatches tasks with a hash of their code, which workers fetch
+// from the supervisor when it is not in their cache. Version 3 adds jobs
+// whose code is a bundle of files, version 4 the files tasks output,
+// version 5 resource limits and version 6 a cap on tasks' output. Version 7
+// stamps the lines of output streamed while tasks run. Version 8 heartbeats
+// name the worker's host:port.
+const ProtocolVersion = 8
+
+// The oldest protocol version this binary still understands. Each version
+// since the first changed what a worker has to do with a task, so none of
+// them can be mixed; raise this along with ProtocolVersion whenever a new
+// version is not compatible with the one before.
+const MinProtocolVersion = 7
+
+// Returned when a message comes from a binary that speaks an unsupported
+// version of the protocol
+type VersionError struct {
+	Version int
+}
+
+func (e *VersionError) Error() string {
+	if e.Version == 0 {
+		return fmt.Sprintf("message has no protocol version, it was probably sent by an older binary "+
+			"(this binary speaks protocol versions %d through %d)", MinProtocolVersion, ProtocolVersion)
+	}
+	return fmt.Sprintf("protocol version %d is not supported, this binary speaks versions %d through %d",
+		e.Version, MinProtocolVersion, ProtocolVersion)
+}
+
+/**
+ * Checks that a message's protocol version is one this binary understands
+ */
+func checkVersion(version int) error {
+	if version < MinProtocolVersion || version > ProtocolVersion {
+		return &VersionError{version}
+	}
+	return nil
+}
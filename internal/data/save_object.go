@@ -3,39 +3,37 @@ package data
 
 import (
 	"encoding/json"
-	"log"
-	"os"
 	"time"
 )
 
 type Client struct {
-	Id   int
-	Time time.Time
+	Version int // ProtocolVersion of the sender
+	Id      int
+	Time    time.Time
 }
 
 /**
  * Saves a client's information into json
  */
-func ClientToJson(client Client) []byte {
+func ClientToJson(client Client) ([]byte, error) {
+
+	// Stamp client with this binary's protocol version
+	client.Version = ProtocolVersion
 
 	// Save c as json byte array
 	b, err := json.Marshal(client)
 
-	// Exit on error, otherwise return b
-	if err != nil {
-		log.Println(err)
-		os.Exit(-1)
-	}
-	return b
+	// Return b along with any error
+	return b, err
 }
 
 /**
  * Saves a client's information into json
  */
-func ClientDataToJson(id int, time time.Time) []byte {
+func ClientDataToJson(id int, time time.Time) ([]byte, error) {
 
 	// Create Client Object
-	c := Client{id, time}
+	c := Client{Id: id, Time: time}
 
 	return ClientToJson(c)
 }
@@ -43,21 +41,21 @@ func ClientDataToJson(id int, time time.Time) []byte {
 /**
  * converts a []byte of json into a client struct
  */
-func JsonToClient(b []byte) Client {
+func JsonToClient(b []byte) (Client, error) {
 	var c Client
 
 	// Unmarshall b into Client c
 	err := json.Unmarshal(b, &c)
-
-	// Exit on error, otherwise return c
-	if err != nil {
-		log.Println(err)
-		os.Exit(-1)
+	if err == nil {
+		err = checkVersion(c.Version)
 	}
-	return c
+
+	// Return c along with any error
+	return c, err
 }
 
 type Job struct {
+	Version        int // ProtocolVersion of the sender
 	Id             int
 	Time           time.Time
 	Machines       int
@@ -66,34 +64,95 @@ type Job struct {
 	FileName       string
 	Extension      string
 	Code           []byte
+	CodeHash       string   // HashCode of Code; tasks are dispatched with only the hash
+	Bundle         string   // Archive format of Code, empty for a single file
+	Outputs        []string // Glob patterns of files to collect from each task's working directory
+	Limits         Limits
 	Args           []string
 	Nruns          int
+	Timeout        time.Duration // Wall-clock limit for each task, 0 for the supervisor's default
+	Retry          RetryPolicy
+	TaskId         string // Set by the supervisor on the tasks it dispatches
+	Priority       int    // Jobs with a higher priority are run first
+	Requires       Requirements
+	Submitter      string // user@host of the client that submitted the job
+	Attempt        int    // Set by the supervisor on the tasks it dispatches
 }
 
+// What a worker must have to be given a job's tasks. Zero values impose no
+// requirement.
+type Requirements struct {
+	MinCores  int    // Cores reported at registration
+	MinMemory int    // Available memory in kB, as reported by the worker's last heartbeat
+	CpuModel  string // Regular expression matched against the worker's CPU model name
+}
+
+// Resources each task of a job may use. Zero values impose no limit.
+type Limits struct {
+	CpuTime   time.Duration // CPU time, after which the task is killed
+	Memory    int64         // Bytes of memory with a cgroup, otherwise of address space
+	OpenFiles int           // Open file descriptors
+	Processes int           // Processes in the task's cgroup, otherwise of the worker's user
+	Output    int64         // Bytes of stdout and of stderr kept, beyond which they are cut off
+}
+
+// Limits a worker can tell killed a task
+const (
+	LimitCpuTime   = "cpu-time"
+	LimitMemory    = "memory"
+	LimitProcesses = "processes"
+)
+
+// How the supervisor handles a task that fails. Only application failures
+// count as attempts; infrastructure failures are always retried.
+type RetryPolicy struct {
+	MaxAttempts  int           // Times a task may run before it is marked failed, 0 means 1
+	Backoff      time.Duration // Wait before the first retry, doubled for every retry after it
+	RetryOn      []int         // Exit codes worth retrying, empty means any non-zero code
+	NeverRetryOn []int         // Exit codes that are never retried
+}
+
+// Kinds of task failure
+const (
+	FailureApplication    = "application"    // The task exited non-zero or ran past its limit
+	FailureInfrastructure = "infrastructure" // The worker died or could not be reached
+	FailureCancelled      = "cancelled"      // The task's job was cancelled
+)
+
 /**
  * Saves a Job information into json
  */
-func JobToJson(job Job) []byte {
+func JobToJson(job Job) ([]byte, error) {
+
+	// Stamp job with this binary's protocol version
+	job.Version = ProtocolVersion
 
 	// Save c as json byte array
 	b, err := json.Marshal(job)
 
-	// Exit on error, otherwise return b
-	if err != nil {
-		log.Println(err)
-		os.Exit(-1)
-	}
-	return b
+	// Return b along with any error
+	return b, err
 }
 
 /**
  * Saves a Job information into json
  */
 func JobDataToJson(id int, time time.Time, machines int,
-	parameterStart int, parameterEnd int, fileName string, extension string, code []byte, args []string, nruns int) []byte {
+	parameterStart int, parameterEnd int, fileName string, extension string, code []byte, args []string, nruns int) ([]byte, error) {
 
 	// Create Job Object
-	j := Job{id, time, machines, parameterStart, parameterEnd, fileName, extension, code, args, nruns}
+	j := Job{
+		Id:             id,
+		Time:           time,
+		Machines:       machines,
+		ParameterStart: parameterStart,
+		ParameterEnd:   parameterEnd,
+		FileName:       fileName,
+		Extension:      extension,
+		Code:           code,
+		Args:           args,
+		Nruns:          nruns,
+	}
 
 	return JobToJson(j)
 }
@@ -101,21 +160,21 @@ func JobDataToJson(id int, time time.Time, machines int,
 /**
  * converts a []byte of json into a Job struct
  */
-func JsonToJob(b []byte) Job {
+func JsonToJob(b []byte) (Job, error) {
 	var j Job
 
 	// Unmarshall b into Job j
 	err := json.Unmarshal(b, &j)
-
-	// Exit on error, otherwise return j
-	if err != nil {
-		log.Println(err)
-		os.Exit(-1)
+	if err == nil {
+		err = checkVersion(j.Version)
 	}
-	return j
+
+	// Return j along with any error
+	return j, err
 }
 
 type Worker struct {
+	Version  int // ProtocolVersion of the sender
 	Id       int64
 	Busy     bool
 	Hostname string
@@ -124,26 +183,25 @@ type Worker struct {
 /**
  * Saves a Worker information into json
  */
-func WorkerToJson(worker Worker) []byte {
+func WorkerToJson(worker Worker) ([]byte, error) {
+
+	// Stamp worker with this binary's protocol version
+	worker.Version = ProtocolVersion
 
 	// Save c as json byte array
 	b, err := json.Marshal(worker)
 
-	// Exit on error, otherwise return b
-	if err != nil {
-		log.Println(err)
-		os.Exit(-1)
-	}
-	return b
+	// Return b along with any error
+	return b, err
 }
 
 /**
  * Saves a Worker information into json
  */
-func WorkerDataToJson(id int64, busy bool, hostname string) []byte {
+func WorkerDataToJson(id int64, busy bool, hostname string) ([]byte, error) {
 
 	// Create Worker Object
-	w := Worker{id, busy, hostname}
+	w := Worker{Id: id, Busy: busy, Hostname: hostname}
 
 	return WorkerToJson(w)
 }
@@ -151,26 +209,27 @@ func WorkerDataToJson(id int64, busy bool, hostname string) []byte {
 /**
  * Converts a []byte of json into a Worker struct
  */
-func JsonToWorker(b []byte) Worker {
+func JsonToWorker(b []byte) (Worker, error) {
 	var w Worker
 
 	// Unmarshall b into Worker w
 	err := json.Unmarshal(b, &w)
-
-	// Exit on error, otherwise return j
-	if err != nil {
-		log.Println(err)
-		os.Exit(-1)
+	if err == nil {
+		err = checkVersion(w.Version)
 	}
-	return w
+
+	// Return w along with any error
+	return w, err
 }
 
 type Registration struct {
+	Version      int // ProtocolVersion of the sender
 	Hostname     string
 	Cores        int
 	ModelName    string
 	CpuSpeed     float64
 	MemAvailable int
+	Encodings    []string // Job encodings the worker accepts
 }
 
 /** -- RegistrationDataToJson --------------------------------------------------
@@ -178,17 +237,16 @@ type Registration struct {
  * @param registration Registration struct
  * @return []byte of json
  ** --------------------------------------------------------------------------*/
-func RegistrationToJson(reg Registration) []byte {
+func RegistrationToJson(reg Registration) ([]byte, error) {
+
+	// Stamp reg with this binary's protocol version
+	reg.Version = ProtocolVersion
 
 	// Save c as json byte array
 	b, err := json.Marshal(reg)
 
-	// Exit on error, otherwise return b
-	if err != nil {
-		log.Println(err)
-		os.Exit(-1)
-	}
-	return b
+	// Return b along with any error
+	return b, err
 }
 
 /** -- RegistrationToJson -------------------------------------------------------
@@ -200,10 +258,16 @@ func RegistrationToJson(reg Registration) []byte {
  * @param mem_available int
  * @return []byte of json
  ** --------------------------------------------------------------------------*/
-func RegistrationDataToJson(hostname string, cores int, model_name string, cpu_speed float64, mem_available int) []byte {
+func RegistrationDataToJson(hostname string, cores int, model_name string, cpu_speed float64, mem_available int) ([]byte, error) {
 
 	// Create Registration Object
-	r := Registration{hostname, cores, model_name, cpu_speed, mem_available}
+	r := Registration{
+		Hostname:     hostname,
+		Cores:        cores,
+		ModelName:    model_name,
+		CpuSpeed:     cpu_speed,
+		MemAvailable: mem_available,
+	}
 
 	return RegistrationToJson(r)
 }
@@ -213,16 +277,314 @@ func RegistrationDataToJson(hostname string, cores int, model_name string, cpu_s
  * @param b []byte
  * @return Registration struct
  ** --------------------------------------------------------------------------*/
-func JsonToRegistration(b []byte) Registration {
+func JsonToRegistration(b []byte) (Registration, error) {
 	var r Registration
 
 	// Unmarshall b into Registration r
 	err := json.Unmarshal(b, &r)
+	if err == nil {
+		err = checkVersion(r.Version)
+	}
+
+	// Return r along with any error
+	return r, err
+}
+
+// Job states reported by the supervisor
+const (
+	JobQueued    = "queued"
+	JobRunning   = "running"
+	JobDone      = "done"
+	JobFailed    = "failed"
+	JobCancelled = "cancelled"
+)
+
+type JobStatus struct {
+	Version   int // ProtocolVersion of the sender
+	Id        int
+	Status    string
+	Priority  int
+	Tasks     int
+	Queued    int
+	Running   int
+	Done      int
+	Failed    int
+	Cancelled int // Tasks that never ran because the job was cancelled
+	Submitted time.Time
+	Finished  time.Time
+}
+
+/**
+ * Saves a JobStatus into json
+ */
+func JobStatusToJson(status JobStatus) ([]byte, error) {
+
+	// Stamp status with this binary's protocol version
+	status.Version = ProtocolVersion
+
+	// Save status as json byte array
+	b, err := json.Marshal(status)
+
+	// Return b along with any error
+	return b, err
+}
+
+/**
+ * Converts a []byte of json into a JobStatus struct
+ */
+func JsonToJobStatus(b []byte) (JobStatus, error) {
+	var s JobStatus
+
+	// Unmarshall b into JobStatus s
+	err := json.Unmarshal(b, &s)
+	if err == nil {
+		err = checkVersion(s.Version)
+	}
+
+	// Return s along with any error
+	return s, err
+}
+
+// The outcome of one attempt of a task. The worker fills in what happened
+// when it ran the task; the supervisor classifies failures.
+type TaskResult struct {
+	Version       int // ProtocolVersion of the sender
+	JobId         int
+	TaskId        string
+	Parameterized bool
+	Parameter     int
+	Attempt       int
+	Worker        string // Hostname of the worker that ran the task
+	Stdout        string
+	Stderr        string
+	ExitCode      int
+	Signal        string // Signal that ended the task, if any
+	Start         time.Time
+	End           time.Time
+	Failed        bool
+	Failure       string // FailureApplication, FailureInfrastructure or FailureCancelled
+	Note          string // Added by the supervisor, e.g. why the task was failed
+	Limit         string // LimitCpuTime, LimitMemory or LimitProcesses if one killed the task
+	Artifacts     []Artifact
+	Orphans       int             // Processes the task left running, which the worker ended
+	Spilled       []SpilledOutput // Streams too long for Stdout and Stderr
+	Truncated     []string        // Streams cut off at Limits.Output
+}
+
+// A stream of a task's output too long to be all in its result, which only
+// has the start of it. The supervisor keeps all of it and serves it, by range
+// if asked, from /jobs/{id}/output/{task id}/{stream}.
+type SpilledOutput struct {
+	Stream string // StreamStdout or StreamStderr
+	Size   int64
+}
+
+// A file a task produced that matched one of its job's Outputs. The worker
+// uploads it to the supervisor, at /jobs/{id}/artifacts/{task id}/{name}.
+type Artifact struct {
+	Name string // Slash separated path within the task's working directory
+	Size int64
+}
+
+/**
+ * Saves a TaskResult into json
+ */
+func TaskResultToJson(result TaskResult) ([]byte, error) {
+
+	// Stamp result with this binary's protocol version
+	result.Version = ProtocolVersion
+
+	// Save result as json byte array
+	b, err := json.Marshal(result)
+
+	// Return b along with any error
+	return b, err
+}
+
+/**
+ * Converts a []byte of json into a TaskResult struct
+ */
+func JsonToTaskResult(b []byte) (TaskResult, error) {
+	var r TaskResult
+
+	// Unmarshall b into TaskResult r
+	err := json.Unmarshal(b, &r)
+	if err == nil {
+		err = checkVersion(r.Version)
+	}
+
+	// Return r along with any error
+	return r, err
+}
+
+/**
+ * Saves a list of TaskResults into json
+ */
+func TaskResultsToJson(results []TaskResult) ([]byte, error) {
+
+	// Stamp a copy of every entry with this binary's protocol version
+	stamped := make([]TaskResult, len(results))
+	for i, entry := range results {
+		entry.Version = ProtocolVersion
+		stamped[i] = entry
+	}
+
+	// Save results as json byte array
+	b, err := json.Marshal(stamped)
+
+	// Return b along with any error
+	return b, err
+}
+
+/**
+ * Converts a []byte of json into a list of TaskResults
+ */
+func JsonToTaskResults(b []byte) ([]TaskResult, error) {
+	var r []TaskResult
+
+	// Unmarshall b into results r
+	err := json.Unmarshal(b, &r)
+	for _, entry := range r {
+		if err == nil {
+			err = checkVersion(entry.Version)
+		}
+	}
+
+	// Return r along with any error
+	return r, err
+}
 
-	// Exit on error, otherwise return r
-	if err != nil {
-		log.Println(err)
-		os.Exit(-1)
+// A finished job as kept in the supervisor's history
+type JobSummary struct {
+	Version        int // ProtocolVersion of the sender
+	Id             int
+	Status         string
+	Submitter      string
+	FileName       string
+	Args           []string
+	ParameterStart int
+	ParameterEnd   int
+	Nruns          int
+	Tasks          int
+	Failed         int
+	ExitCodes      []int // Exit code of each task, ordered by parameter
+	Submitted      time.Time
+	Started        time.Time
+	Finished       time.Time
+}
+
+/**
+ * Saves a list of JobSummaries into json
+ */
+func HistoryToJson(history []JobSummary) ([]byte, error) {
+
+	// Stamp a copy of every entry with this binary's protocol version
+	stamped := make([]JobSummary, len(history))
+	for i, entry := range history {
+		entry.Version = ProtocolVersion
+		stamped[i] = entry
 	}
-	return r
+
+	// Save history as json byte array
+	b, err := json.Marshal(stamped)
+
+	// Return b along with any error
+	return b, err
+}
+
+/**
+ * Converts a []byte of json into a list of JobSummaries
+ */
+func JsonToHistory(b []byte) ([]JobSummary, error) {
+	var h []JobSummary
+
+	// Unmarshall b into history h
+	err := json.Unmarshal(b, &h)
+	for _, entry := range h {
+		if err == nil {
+			err = checkVersion(entry.Version)
+		}
+	}
+
+	// Return h along with any error
+	return h, err
+}
+
+// How often a worker reports to the supervisor that it is still alive
+const HeartbeatInterval = 2 * time.Second
+
+// Longest a worker spends fetching the code of a task before running it,
+// and handing the files the task output over to the supervisor afterwards.
+// The supervisor leases a task to a worker for the task's time limit plus
+// both.
+const FetchTimeout = 2 * time.Minute
+const UploadTimeout = 5 * time.Minute
+
+type Heartbeat struct {
+	Version      int // ProtocolVersion of the sender
+	WorkerId     int64
+	Hostname     string // host:port the worker registered with
+	Load         float64
+	MemAvailable int
+}
+
+/**
+ * Saves a Heartbeat into json
+ */
+func HeartbeatToJson(hb Heartbeat) ([]byte, error) {
+
+	// Stamp hb with this binary's protocol version
+	hb.Version = ProtocolVersion
+
+	// Save hb as json byte array
+	b, err := json.Marshal(hb)
+
+	// Return b along with any error
+	return b, err
+}
+
+/**
+ * Converts a []byte of json into a Heartbeat struct
+ */
+func JsonToHeartbeat(b []byte) (Heartbeat, error) {
+	var hb Heartbeat
+
+	// Unmarshall b into Heartbeat hb
+	err := json.Unmarshal(b, &hb)
+	if err == nil {
+		err = checkVersion(hb.Version)
+	}
+
+	// Return hb along with any error
+	return hb, err
+}
+
+// The body of a reply to a request that could not be handled
+type Error struct {
+	Error string
+}
+
+/**
+ * Saves an Error into json
+ */
+func ErrorToJson(e Error) ([]byte, error) {
+
+	// Save e as json byte array
+	b, err := json.Marshal(e)
+
+	// Return b along with any error
+	return b, err
+}
+
+/**
+ * Converts a []byte of json into an Error struct
+ */
+func JsonToError(b []byte) (Error, error) {
+	var e Error
+
+	// Unmarshall b into Error e
+	err := json.Unmarshal(b, &e)
+
+	// Return e along with any error
+	return e, err
 }
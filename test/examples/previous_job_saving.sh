@@ -4,9 +4,15 @@ cd error_codes
 make
 
 echo "-----------Original Run------------"
-./client http://localhost:5044 example
+./client -detach http://localhost:5044 example > submitted.txt
+cat submitted.txt
+id=$(awk '{print $3}' submitted.txt)
+sleep 2
 echo "---Replay of Previous Job Result---"
-cat ../supervisor/lastjob.txt
+./client results http://localhost:5044 $id
+echo "-------------Job History-----------"
+./client history http://localhost:5044
 echo "-----------------------------------"
 
+rm -f submitted.txt
 make clean